@@ -32,6 +32,12 @@ func EnableDebugLogging() {
 	_, dumpPayloads = os.LookupEnv("PROXY_DUMP_PAYLOADS")
 }
 
+// EnablePayloadDumps enables dumping payloads, which also requires debug
+// logging to be enabled.
+func EnablePayloadDumps() {
+	dumpPayloads = true
+}
+
 // Debug prints a debug log with the given parameters if debug logging is
 // enabled.
 func Debug(msg ...interface{}) {
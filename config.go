@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/proxy"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config is a struct that holds the configuration of the CLI, i.e. the
+// proxy's along with the settings only the CLI uses.
+type config struct {
+	proxy.Options
+
+	debugLog     bool
+	dumpPayloads bool
+	drainTimeout time.Duration
+	jaegerHost   string
+	serverName   string
+}
+
+// configFile is a struct that represents the YAML configuration file given
+// with --config. Settings missing from the file keep their previous value.
+type configFile struct {
+	Listen struct {
+		CoAP  string `yaml:"coap"`
+		HTTP  string `yaml:"http"`
+		Admin string `yaml:"admin"`
+	} `yaml:"listen"`
+	Targets struct {
+		HTTP     string `yaml:"http"`
+		CoAP     string `yaml:"coap"`
+		CoAPPort string `yaml:"coap_port"`
+	} `yaml:"targets"`
+	Maps struct {
+		Dir          string   `yaml:"dir"`
+		PreviousDirs []string `yaml:"previous_dirs"`
+		Mismatch     string   `yaml:"mismatch"`
+		Compression  string   `yaml:"compression"`
+	} `yaml:"maps"`
+	Encryption struct {
+		Enabled   bool   `yaml:"enabled"`
+		StaticKey string `yaml:"static_key"`
+	} `yaml:"encryption"`
+	Connections struct {
+		HeartbeatInterval time.Duration    `yaml:"heartbeat_interval"`
+		HeartbeatTimeout  time.Duration    `yaml:"heartbeat_timeout"`
+		IdleTimeout       time.Duration    `yaml:"idle_timeout"`
+		DrainTimeout      time.Duration    `yaml:"drain_timeout"`
+		BlockSize         int              `yaml:"block_size"`
+		MaxMessageSize    int              `yaml:"max_message_size"`
+		Retries           retryConfig      `yaml:"retries"`
+		Congestion        congestionConfig `yaml:"congestion"`
+		ObserveSync       bool             `yaml:"observe_sync"`
+		BatchWindow       time.Duration    `yaml:"batch_window"`
+		MaxBatch          int              `yaml:"max_batch"`
+	} `yaml:"connections"`
+	DropErrorMessages bool `yaml:"drop_error_messages"`
+	CacheSize         int  `yaml:"cache_size"`
+	StoreForward      struct {
+		Dir           string        `yaml:"dir"`
+		Routes        []string      `yaml:"routes"`
+		Status        int           `yaml:"status"`
+		RetryInterval time.Duration `yaml:"retry_interval"`
+		MaxQueue      int           `yaml:"max_queue"`
+	} `yaml:"store_forward"`
+	Logging struct {
+		Debug        bool `yaml:"debug"`
+		DumpPayloads bool `yaml:"dump_payloads"`
+	} `yaml:"logging"`
+	Tracing struct {
+		JaegerHost string `yaml:"jaeger_host"`
+		ServerName string `yaml:"server_name"`
+	} `yaml:"tracing"`
+	Peers []peerConfig `yaml:"peers"`
+}
+
+// peerConfig is a struct that represents an entry of the peers section of the
+// configuration file.
+type peerConfig struct {
+	Name           string            `yaml:"name"`
+	Address        string            `yaml:"address"`
+	Encryption     *bool             `yaml:"encryption"`
+	MapsVersion    string            `yaml:"maps_version"`
+	BlockSize      int               `yaml:"block_size"`
+	MaxMessageSize int               `yaml:"max_message_size"`
+	Retries        *retryConfig      `yaml:"retries"`
+	Congestion     *congestionConfig `yaml:"congestion"`
+}
+
+// retryConfig is a struct that represents a retries section of the
+// configuration file. Settings missing from it keep the value they have in the
+// retry options it's applied on top of.
+type retryConfig struct {
+	Count          *int           `yaml:"count"`
+	InitialBackoff *time.Duration `yaml:"initial_backoff"`
+	Multiplier     *int           `yaml:"multiplier"`
+	MaxBackoff     *time.Duration `yaml:"max_backoff"`
+	Adaptive       *bool          `yaml:"adaptive"`
+	MinBackoff     *time.Duration `yaml:"min_backoff"`
+}
+
+// merge is a function that returns the given retry options overridden by the
+// settings of the retries section.
+func (rc *retryConfig) merge(opts proxy.RetryOptions) proxy.RetryOptions {
+	if rc.Count != nil {
+		opts.Count = *rc.Count
+	}
+	if rc.InitialBackoff != nil {
+		opts.InitialBackoff = *rc.InitialBackoff
+	}
+	if rc.Multiplier != nil {
+		opts.Multiplier = *rc.Multiplier
+	}
+	if rc.MaxBackoff != nil {
+		opts.MaxBackoff = *rc.MaxBackoff
+	}
+	if rc.Adaptive != nil {
+		opts.Adaptive = *rc.Adaptive
+	}
+	if rc.MinBackoff != nil {
+		opts.MinBackoff = *rc.MinBackoff
+	}
+
+	return opts
+}
+
+// congestionConfig is a struct that represents a congestion section of the
+// configuration file. Settings missing from it keep the value they have in the
+// congestion options it's applied on top of.
+type congestionConfig struct {
+	MaxOutstanding *int           `yaml:"max_outstanding"`
+	BytesPerSecond *int           `yaml:"bytes_per_second"`
+	MaxQueue       *int           `yaml:"max_queue"`
+	PriorityAging  *time.Duration `yaml:"priority_aging"`
+}
+
+// merge is a function that returns the given congestion options overridden by
+// the settings of the congestion section.
+func (cc *congestionConfig) merge(opts proxy.CongestionOptions) proxy.CongestionOptions {
+	if cc.MaxOutstanding != nil {
+		opts.MaxOutstanding = *cc.MaxOutstanding
+	}
+	if cc.BytesPerSecond != nil {
+		opts.BytesPerSecond = *cc.BytesPerSecond
+	}
+	if cc.MaxQueue != nil {
+		opts.MaxQueue = *cc.MaxQueue
+	}
+	if cc.PriorityAging != nil {
+		opts.PriorityAging = *cc.PriorityAging
+	}
+
+	return opts
+}
+
+// loadConfigFile is a function that applies the settings of the given YAML
+// configuration file on top of the given configuration. Unknown settings are
+// rejected.
+func loadConfigFile(path string, cfg *config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	f := newConfigFile(cfg)
+	if err = yaml.UnmarshalStrict(b, f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err = f.apply(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// newConfigFile is a function that returns a configFile holding the given
+// configuration, for a configuration file to be decoded on top of it.
+func newConfigFile(cfg *config) *configFile {
+	f := new(configFile)
+
+	f.Listen.CoAP = cfg.CoAPAddr
+	f.Listen.HTTP = cfg.HTTPAddr
+	f.Listen.Admin = cfg.AdminAddr
+	f.Targets.HTTP = cfg.HTTPTarget
+	f.Targets.CoAP = cfg.CoAPTarget
+	f.Targets.CoAPPort = cfg.CoAPPort
+	f.Maps.Dir = cfg.MapsDir
+	f.Maps.PreviousDirs = cfg.PreviousMapsDirs
+	f.Maps.Mismatch = cfg.MapsMismatch
+	f.Maps.Compression = cfg.Compression
+	f.Encryption.Enabled = !cfg.DisableEncryption
+	f.Encryption.StaticKey = hex.EncodeToString(cfg.StaticKey)
+	f.Connections.HeartbeatInterval = cfg.HeartbeatInterval
+	f.Connections.HeartbeatTimeout = cfg.HeartbeatTimeout
+	f.Connections.IdleTimeout = cfg.IdleTimeout
+	f.Connections.DrainTimeout = cfg.drainTimeout
+	f.Connections.BlockSize = cfg.BlockSize
+	f.Connections.MaxMessageSize = cfg.MaxMessageSize
+	f.Connections.ObserveSync = cfg.ObserveSync
+	f.Connections.BatchWindow = cfg.BatchWindow
+	f.Connections.MaxBatch = cfg.MaxBatch
+	f.DropErrorMessages = cfg.DropErrorMessages
+	f.CacheSize = cfg.CacheSize
+	f.StoreForward.Dir = cfg.StoreForward.Dir
+	f.StoreForward.Routes = cfg.StoreForward.Routes
+	f.StoreForward.Status = cfg.StoreForward.Status
+	f.StoreForward.RetryInterval = cfg.StoreForward.RetryInterval
+	f.StoreForward.MaxQueue = cfg.StoreForward.MaxQueue
+	f.Logging.Debug = cfg.debugLog
+	f.Logging.DumpPayloads = cfg.dumpPayloads
+	f.Tracing.JaegerHost = cfg.jaegerHost
+	f.Tracing.ServerName = cfg.serverName
+
+	return f
+}
+
+// apply is a function that copies the settings of the configuration file into
+// the given configuration.
+func (f *configFile) apply(cfg *config) error {
+	staticKey, err := hex.DecodeString(f.Encryption.StaticKey)
+	if err != nil {
+		return fmt.Errorf("encryption.static_key: %v", err)
+	}
+
+	cfg.CoAPAddr = f.Listen.CoAP
+	cfg.HTTPAddr = f.Listen.HTTP
+	cfg.AdminAddr = f.Listen.Admin
+	cfg.HTTPTarget = f.Targets.HTTP
+	cfg.CoAPTarget = f.Targets.CoAP
+	cfg.CoAPPort = f.Targets.CoAPPort
+	cfg.MapsDir = f.Maps.Dir
+	cfg.PreviousMapsDirs = f.Maps.PreviousDirs
+	cfg.MapsMismatch = f.Maps.Mismatch
+	cfg.Compression = f.Maps.Compression
+	cfg.DisableEncryption = !f.Encryption.Enabled
+	cfg.StaticKey = staticKey
+	cfg.HeartbeatInterval = f.Connections.HeartbeatInterval
+	cfg.HeartbeatTimeout = f.Connections.HeartbeatTimeout
+	cfg.IdleTimeout = f.Connections.IdleTimeout
+	cfg.drainTimeout = f.Connections.DrainTimeout
+	cfg.BlockSize = f.Connections.BlockSize
+	cfg.MaxMessageSize = f.Connections.MaxMessageSize
+	cfg.Retries = f.Connections.Retries.merge(cfg.Retries)
+	cfg.Congestion = f.Connections.Congestion.merge(cfg.Congestion)
+	cfg.ObserveSync = f.Connections.ObserveSync
+	cfg.BatchWindow = f.Connections.BatchWindow
+	cfg.MaxBatch = f.Connections.MaxBatch
+	cfg.DropErrorMessages = f.DropErrorMessages
+	cfg.CacheSize = f.CacheSize
+	cfg.StoreForward = proxy.StoreForwardOptions{
+		Dir:           f.StoreForward.Dir,
+		Routes:        f.StoreForward.Routes,
+		Status:        f.StoreForward.Status,
+		RetryInterval: f.StoreForward.RetryInterval,
+		MaxQueue:      f.StoreForward.MaxQueue,
+	}
+	cfg.debugLog = f.Logging.Debug
+	cfg.dumpPayloads = f.Logging.DumpPayloads
+	cfg.jaegerHost = f.Tracing.JaegerHost
+	cfg.serverName = f.Tracing.ServerName
+
+	cfg.Peers = make([]proxy.PeerOptions, 0, len(f.Peers))
+	for _, pc := range f.Peers {
+		var retries *proxy.RetryOptions
+		if pc.Retries != nil {
+			r := pc.Retries.merge(cfg.Retries)
+			retries = &r
+		}
+
+		var congestion *proxy.CongestionOptions
+		if pc.Congestion != nil {
+			c := pc.Congestion.merge(cfg.Congestion)
+			congestion = &c
+		}
+
+		cfg.Peers = append(cfg.Peers, proxy.PeerOptions{
+			Name:           pc.Name,
+			Address:        pc.Address,
+			Encryption:     pc.Encryption,
+			MapsVersion:    pc.MapsVersion,
+			BlockSize:      pc.BlockSize,
+			MaxMessageSize: pc.MaxMessageSize,
+			Retries:        retries,
+			Congestion:     congestion,
+		})
+	}
+
+	return nil
+}
@@ -1,16 +1,22 @@
 module github.com/matrix-org/coap-proxy
 
-go 1.12
+go 1.19
 
 require (
 	github.com/emef/bitfield v0.0.0-20170503144143-7d3f8f823065
 	github.com/flynn/noise v0.0.0-20180327030543-2492fe189ae6
+	github.com/klauspost/compress v1.17.4
 	github.com/matrix-org/go-coap v0.0.0-20190605161234-2b2386eef86a
 	github.com/opentracing/opentracing-go v1.1.0
-	github.com/pkg/errors v0.8.1 // indirect
 	github.com/uber/jaeger-client-go v2.16.0+incompatible
 	github.com/uber/jaeger-lib v2.0.0+incompatible
 	github.com/ugorji/go v1.1.4
+	golang.org/x/net v0.0.0-20190514140710-3ec191127204
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/pkg/errors v0.8.1 // indirect
 	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f // indirect
-	golang.org/x/net v0.0.0-20190514140710-3ec191127204 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
 )
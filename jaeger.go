@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 
 	"github.com/uber/jaeger-client-go"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
@@ -12,20 +11,15 @@ import (
 	"github.com/uber/jaeger-lib/metrics"
 )
 
-// Env flags
-var jaegerHost, useJaeger = os.LookupEnv("SYNAPSE_JAEGER_HOST")
-
 // setupJaegerTracing is a function that sets up OpenTracing with a
-// configuration specific to the CoAP proxy.
-func setupJaegerTracing() io.Closer {
-	jaegerHost := jaegerHost
-	serverName := os.Getenv("SYNAPSE_SERVER_NAME")
-
+// configuration specific to the CoAP proxy, reporting spans to the Jaeger
+// agent on the given host unless it's empty.
+func setupJaegerTracing(jaegerHost, serverName string) io.Closer {
 	serviceName := fmt.Sprintf("proxy-%s", serverName)
 
 	var cfg jaegercfg.Configuration
 
-	if useJaeger {
+	if len(jaegerHost) > 0 {
 		cfg = jaegercfg.Configuration{
 			Sampler: &jaegercfg.SamplerConfig{
 				Type:  jaeger.SamplerTypeConst,
@@ -18,197 +18,318 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"log"
-	"net/http"
-	"path/filepath"
-	"regexp"
-	"runtime/debug"
-	"sync"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/matrix-org/coap-proxy/common"
-	"github.com/matrix-org/coap-proxy/types"
-
-	"github.com/matrix-org/go-coap"
+	"github.com/matrix-org/coap-proxy/proxy"
 )
 
+// defaults is the default configuration of the proxy, which the flags'
+// defaults are taken from.
+var defaults = proxy.DefaultOptions()
+
 var (
 	// CLI flags
-	onlyCoAP     = flag.Bool("only-coap", false, "Only proxy CoAP requests to HTTP and not the other way around")
-	onlyHTTP     = flag.Bool("only-http", false, "Only proxy HTTP requests to CoAP and not the other way around")
-	noEncryption = flag.Bool("disable-encryption", false, "Disable noise encryption")
-	debugLog     = flag.Bool("debug-log", false, "Output debug logs")
-	mapsDir      = flag.String("maps-dir", "maps", "Directory in which the JSON maps live")
-	coapTarget   = flag.String("coap-target", "", "Force the host+port of the CoAP server to talk to")
-	httpTarget   = flag.String("http-target", "http://127.0.0.1:8008", "Force the host+port of the HTTP server to talk to")
-	coapPort     = flag.String("coap-port", "5683", "The CoAP port to listen on")
-	coapBindHost = flag.String("coap-bind-host", "0.0.0.0", "The COAP host to listen on")
-	httpPort     = flag.String("http-port", "8888", "The HTTP port to listen on")
-
-	fedAuthPrefix = "X-Matrix origin="
-	fedAuthSuffix = ",key=\"\",sig=\"\""
-
-	routePatternRgxp = regexp.MustCompile("{[^/]+}")
-	fedAuthRgxp      = regexp.MustCompile(fedAuthPrefix + "([^,]+)")
-
-	// Slices to keep parsed json dictionary data in
-	routes      = make([]route, 0)
-	eventTypes  = make([]string, 0)
-	errorCodes  = make([]string, 0)
-	queryParams = make([]string, 0)
-
-	// CBOR encoder/decoder
-	cbor = new(types.CBOR)
-
-	// JSON encoder/decoder
-	json = new(types.JSON)
-
-	// Implementation of go-coap compressor struct
-	compressor *types.Compressor
+	onlyCoAP         = flag.Bool("only-coap", false, "Only proxy CoAP requests to HTTP and not the other way around")
+	onlyHTTP         = flag.Bool("only-http", false, "Only proxy HTTP requests to CoAP and not the other way around")
+	noEncryption     = flag.Bool("disable-encryption", false, "Disable noise encryption")
+	debugLog         = flag.Bool("debug-log", false, "Output debug logs")
+	mapsDir          = flag.String("maps-dir", defaults.MapsDir, "Directory in which the JSON maps live")
+	coapTarget       = flag.String("coap-target", "", "Force the host+port of the CoAP server to talk to")
+	httpTarget       = flag.String("http-target", defaults.HTTPTarget, "Force the host+port of the HTTP server to talk to")
+	coapPort         = flag.String("coap-port", defaults.CoAPPort, "The CoAP port to listen on")
+	coapBindHost     = flag.String("coap-bind-host", "0.0.0.0", "The COAP host to listen on")
+	httpPort         = flag.String("http-port", "8888", "The HTTP port to listen on")
+	previousMapsDirs = flag.String("previous-maps-dirs", "", "Comma-separated list of directories in which previous generations of the JSON maps live, from the newest to the oldest")
+	adminAddr        = flag.String("admin-addr", "", "The host+port to serve the admin endpoints on, disabled if empty")
+	mapsMismatch     = flag.String("maps-mismatch", defaults.MapsMismatch, "What to do when talking to a proxy with different maps: \"fallback\" to uncompressed paths and payloads, or \"refuse\" to talk to it")
+	dropErrorMsgs    = flag.Bool("drop-error-messages", false, "Drop the human-readable message of Matrix errors sent back over CoAP, the other proxy then fills in a generic one for the error code")
+	compression      = flag.String("compression", defaults.Compression, "The algorithm to compress payloads with the maps' dictionary with: \"flate\" or \"zstd\"")
+	pingInterval     = flag.Duration("heartbeat-interval", defaults.HeartbeatInterval, "How long a connection to another proxy can go without receiving anything before it gets pinged, 0 to disable heartbeats")
+	pingTimeout      = flag.Duration("heartbeat-timeout", defaults.HeartbeatTimeout, "How long to wait for the answer to a ping before considering the connection dead")
+	idleTimeout      = flag.Duration("idle-timeout", defaults.IdleTimeout, "How long a connection to another proxy can go unused before it gets closed, 0 to keep connections open forever")
+	drainTimeout     = flag.Duration("drain-timeout", 30*time.Second, "How long to wait for in-flight requests to be done when shutting down")
+	retryCount       = flag.Int("retry-count", defaults.Retries.Count, "How many times to retransmit an unacknowledged CoAP message before giving up, 0 to keep retransmitting it until the exchange times out")
+	retryBackoff     = flag.Duration("retry-initial-backoff", defaults.Retries.InitialBackoff, "How long to wait for the acknowledgement of a CoAP message before retransmitting it for the first time")
+	retryMultiplier  = flag.Int("retry-multiplier", defaults.Retries.Multiplier, "What to multiply the backoff by after each retransmission")
+	retryMaxBackoff  = flag.Duration("retry-max-backoff", defaults.Retries.MaxBackoff, "The longest the backoff between two retransmissions can get, 0 for no limit")
+	retryAdaptive    = flag.Bool("retry-adaptive", defaults.Retries.Adaptive, "Derive the initial backoff of new connections from the round-trip times measured to the other proxy")
+	retryMinBackoff  = flag.Duration("retry-min-backoff", defaults.Retries.MinBackoff, "The shortest the initial backoff can get when it's adaptive")
+	maxOutstanding   = flag.Int("congestion-max-outstanding", defaults.Congestion.MaxOutstanding, "The most exchanges which can be in flight with another proxy at once, 0 for no limit")
+	bytesPerSecond   = flag.Int("congestion-bytes-per-second", defaults.Congestion.BytesPerSecond, "The rate at which payload bytes can be exchanged with another proxy, 0 for no limit")
+	maxQueue         = flag.Int("congestion-max-queue", defaults.Congestion.MaxQueue, "How many requests can wait to be sent to another proxy before new ones get a 503")
+	priorityAging    = flag.Duration("congestion-priority-aging", defaults.Congestion.PriorityAging, "How long a request waiting to be sent to another proxy takes to move up one priority, 0 to disable")
+	blockSize        = flag.Int("block-size", defaults.BlockSize, "The size in bytes of the blocks of block-wise transfers: 16, 32, 64, 128, 256, 512 or 1024")
+	maxMessageSize   = flag.Int("max-message-size", defaults.MaxMessageSize, "The largest payload in bytes to accept from another proxy, 0 for no limit")
+	observeSync      = flag.Bool("observe-sync", defaults.ObserveSync, "Observe clients' syncs with other proxies instead of long-polling them over CoAP, and let other proxies observe them")
+	cacheSize        = flag.Int("cache-size", defaults.CacheSize, "How many bytes of responses from other proxies to GET requests on routes with a max age in the maps to cache, 0 to disable caching")
+	sfDir            = flag.String("store-forward-dir", defaults.StoreForward.Dir, "Directory to store the requests queued until the other proxy can be reached in, store-and-forward is disabled if empty")
+	sfRoutes         = flag.String("store-forward-routes", strings.Join(defaults.StoreForward.Routes, ","), "Comma-separated list of the routes which requests can be queued, as the method and path of their entry in routes.json")
+	sfStatus         = flag.Int("store-forward-status", defaults.StoreForward.Status, "The HTTP status code to answer queued requests with")
+	sfRetryInterval  = flag.Duration("store-forward-retry-interval", defaults.StoreForward.RetryInterval, "How long to wait before trying to send the requests queued for another proxy again")
+	sfMaxQueue       = flag.Int("store-forward-max-queue", defaults.StoreForward.MaxQueue, "How many requests can be queued for another proxy, 0 for no limit")
+	batchWindow      = flag.Duration("batch-window", defaults.BatchWindow, "How long to wait for more federation transactions to the same proxy before sending them together, 0 to disable batching")
+	maxBatch         = flag.Int("batch-max", defaults.MaxBatch, "The largest number of federation transactions to send together")
+	configPath       = flag.String("config", "", "Path to a YAML configuration file, which the flags explicitly set override")
+	checkConfig      = flag.Bool("check-config", false, "Check the configuration is valid, then exit")
 )
 
 func init() {
 	log.Printf("Starting up...")
 
 	flag.Parse()
+}
 
-	if *debugLog {
-		common.EnableDebugLogging()
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	if *noEncryption {
-		log.Printf("Encryption disabled")
-	} else {
-		log.Printf("Encryption enabled")
+	if cfg.debugLog {
+		common.EnableDebugLogging()
+	}
+	if cfg.dumpPayloads {
+		common.EnablePayloadDumps()
 	}
 
-	conns = make(map[string]*openConn)
-
-	var err error
+	if *checkConfig {
+		if err = cfg.Options.Validate(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
 
-	// Parse maps for later compression purposes. These allow for compression
-	// something like a known Matrix API endpoint route down into a single integer.
-	if err = json.ParseFile(
-		filepath.Join(*mapsDir, "routes.json"),
-		&routes,
-	); err != nil {
-		panic(err)
+		log.Println("Configuration is valid")
+		os.Exit(0)
 	}
 
-	if err = json.ParseFile(
-		filepath.Join(*mapsDir, "query_params.json"),
-		&queryParams,
-	); err != nil {
-		panic(err)
+	if flag.Arg(0) == "gen-maps" {
+		os.Exit(proxy.GenMaps(cfg.Options, flag.Args()[1:]))
 	}
 
-	if err = json.ParseFile(
-		filepath.Join(*mapsDir, "event_types.json"),
-		&eventTypes,
-	); err != nil {
-		panic(err)
+	p, err := proxy.New(cfg.Options)
+	if err != nil {
+		log.Fatalf("Failed to set up the proxy: %v", err)
 	}
 
-	if compressor, err = types.NewCompressor(*mapsDir, []string{
-		"event_types.json",
-		"common_keys.json",
-		"error_codes.json",
-		"edu_types.json",
-	}, cbor); err != nil {
-		panic(err)
+	closer := setupJaegerTracing(cfg.jaegerHost, cfg.serverName)
+
+	// Reload the maps when receiving SIGHUP
+	go reloadMapsOnSignal(p)
+
+	if err = p.Start(); err != nil {
+		log.Fatalf("Failed to start the proxy: %v", err)
 	}
 
-	log.Println("Finished loading compression maps")
-}
+	// Drain in-flight requests and stop the listeners when receiving SIGINT or
+	// SIGTERM
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-func main() {
-	closer := setupJaegerTracing()
+	sig := <-sigs
+	log.Printf("Got %v, draining in-flight requests for up to %v", sig, cfg.drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.drainTimeout)
+	defer cancel()
+
+	if err = p.Shutdown(ctx); err != nil {
+		log.Printf("ERROR: Failed to shut down cleanly: %v", err)
+	}
+
+	// Flush the spans which haven't been reported yet
 	if closer != nil {
-		defer closer.Close()
-	}
-
-	// Create a wait group to keep main routine alive while HTTP and CoAP servers run in separate routines
-	wg := sync.WaitGroup{}
-	var h *handler
-
-	// Start CoAP listener
-	// Listens for CoAP requests and sends out HTTP
-	if !*onlyHTTP {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			coapAddr := *coapBindHost + ":" + *coapPort
-			log.Printf("Setting up CoAP to HTTP proxy on %s", coapAddr)
-			log.Println(listenAndServe(coapAddr, "udp", coapRecoverWrap(coap.HandlerFunc(ServeCOAP)), compressor))
-			log.Println("CoAP to HTTP proxy exited")
-		}()
-	}
-
-	// Start HTTP listener
-	// Listens for HTTP requests and sends out CoAP
-	if !*onlyCoAP {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			httpAddr := "0.0.0.0:" + *httpPort
-			log.Printf("Setting up HTTP to CoAP proxy on %s", httpAddr)
-			log.Println(http.ListenAndServe(httpAddr, httpRecoverWrap(h)))
-			log.Println("HTTP to CoAP proxy exited")
-		}()
-	}
-
-	wg.Wait()
-
-	// Close all open CoAP connections on program termination
-	for _, c := range conns {
-		if err := c.Close(); err != nil {
-			panic(err)
+		if err := closer.Close(); err != nil {
+			log.Printf("ERROR: Failed to flush traces: %v", err)
 		}
 	}
+
+	log.Println("Shut down")
 }
 
-func httpRecoverWrap(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		defer func() {
-			r := recover()
-			if r != nil {
-				switch t := r.(type) {
-				case string:
-					err = errors.New(t)
-				case error:
-					err = t
-				default:
-					err = errors.New("Unknown error")
-				}
-				log.Printf("Recovered from panic: %v", err)
-				log.Println("Stacktrace:\n" + string(debug.Stack()))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-		}()
-		h.ServeHTTP(w, r)
+// loadConfig is a function that builds the configuration from, by increasing
+// precedence, the defaults, the environment, the configuration file given with
+// --config if any, and the CLI flags which were explicitly set.
+func loadConfig() (*config, error) {
+	cfg := &config{
+		Options:      defaults,
+		debugLog:     *debugLog,
+		drainTimeout: *drainTimeout,
+		jaegerHost:   os.Getenv("SYNAPSE_JAEGER_HOST"),
+		serverName:   os.Getenv("SYNAPSE_SERVER_NAME"),
+	}
+	_, cfg.dumpPayloads = os.LookupEnv("PROXY_DUMP_PAYLOADS")
+
+	if len(*configPath) > 0 {
+		if err := loadConfigFile(*configPath, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = applyFlag(cfg, f.Name)
+		}
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Disabling a listener takes precedence over setting its port.
+	if *onlyCoAP {
+		cfg.HTTPAddr = ""
+	}
+	if *onlyHTTP {
+		cfg.CoAPAddr = ""
+	}
+
+	cfg.Tracing = len(cfg.jaegerHost) > 0
+
+	return cfg, nil
 }
 
-func coapRecoverWrap(h coap.Handler) coap.Handler {
-	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
-		var err error
-		defer func() {
-			r := recover()
-			if r != nil {
-				switch t := r.(type) {
-				case string:
-					err = errors.New(t)
-				case error:
-					err = t
-				default:
-					err = errors.New("Unknown error")
-				}
-				log.Printf("Recovered from panic: %v", err)
-				log.Println("Stacktrace:\n" + string(debug.Stack()))
+// applyFlag is a function that copies the value of the CLI flag with the given
+// name into the given configuration.
+func applyFlag(cfg *config, name string) (err error) {
+	switch name {
+	case "coap-bind-host":
+		cfg.CoAPAddr, err = replaceHost(cfg.CoAPAddr, *coapBindHost, defaults.CoAPAddr)
+	case "coap-port":
+		cfg.CoAPPort = *coapPort
+		cfg.CoAPAddr, err = replacePort(cfg.CoAPAddr, *coapPort, defaults.CoAPAddr)
+	case "http-port":
+		cfg.HTTPAddr, err = replacePort(cfg.HTTPAddr, *httpPort, defaults.HTTPAddr)
+	case "admin-addr":
+		cfg.AdminAddr = *adminAddr
+	case "coap-target":
+		cfg.CoAPTarget = *coapTarget
+	case "http-target":
+		cfg.HTTPTarget = *httpTarget
+	case "disable-encryption":
+		cfg.DisableEncryption = *noEncryption
+	case "debug-log":
+		cfg.debugLog = *debugLog
+	case "maps-dir":
+		cfg.MapsDir = *mapsDir
+	case "previous-maps-dirs":
+		cfg.PreviousMapsDirs = nil
+		for _, dir := range strings.Split(*previousMapsDirs, ",") {
+			if dir = strings.TrimSpace(dir); len(dir) > 0 {
+				cfg.PreviousMapsDirs = append(cfg.PreviousMapsDirs, dir)
 			}
-		}()
-		h.ServeCOAP(w, r)
-	})
+		}
+	case "maps-mismatch":
+		cfg.MapsMismatch = *mapsMismatch
+	case "drop-error-messages":
+		cfg.DropErrorMessages = *dropErrorMsgs
+	case "compression":
+		cfg.Compression = *compression
+	case "heartbeat-interval":
+		cfg.HeartbeatInterval = *pingInterval
+	case "heartbeat-timeout":
+		cfg.HeartbeatTimeout = *pingTimeout
+	case "idle-timeout":
+		cfg.IdleTimeout = *idleTimeout
+	case "retry-count":
+		cfg.Retries.Count = *retryCount
+	case "retry-initial-backoff":
+		cfg.Retries.InitialBackoff = *retryBackoff
+	case "retry-multiplier":
+		cfg.Retries.Multiplier = *retryMultiplier
+	case "retry-max-backoff":
+		cfg.Retries.MaxBackoff = *retryMaxBackoff
+	case "retry-adaptive":
+		cfg.Retries.Adaptive = *retryAdaptive
+	case "retry-min-backoff":
+		cfg.Retries.MinBackoff = *retryMinBackoff
+	case "congestion-max-outstanding":
+		cfg.Congestion.MaxOutstanding = *maxOutstanding
+	case "congestion-bytes-per-second":
+		cfg.Congestion.BytesPerSecond = *bytesPerSecond
+	case "congestion-max-queue":
+		cfg.Congestion.MaxQueue = *maxQueue
+	case "congestion-priority-aging":
+		cfg.Congestion.PriorityAging = *priorityAging
+	case "block-size":
+		cfg.BlockSize = *blockSize
+	case "max-message-size":
+		cfg.MaxMessageSize = *maxMessageSize
+	case "observe-sync":
+		cfg.ObserveSync = *observeSync
+	case "cache-size":
+		cfg.CacheSize = *cacheSize
+	case "store-forward-dir":
+		cfg.StoreForward.Dir = *sfDir
+	case "store-forward-routes":
+		cfg.StoreForward.Routes = nil
+		for _, r := range strings.Split(*sfRoutes, ",") {
+			if r = strings.TrimSpace(r); len(r) > 0 {
+				cfg.StoreForward.Routes = append(cfg.StoreForward.Routes, r)
+			}
+		}
+	case "store-forward-status":
+		cfg.StoreForward.Status = *sfStatus
+	case "store-forward-retry-interval":
+		cfg.StoreForward.RetryInterval = *sfRetryInterval
+	case "store-forward-max-queue":
+		cfg.StoreForward.MaxQueue = *sfMaxQueue
+	case "batch-window":
+		cfg.BatchWindow = *batchWindow
+	case "batch-max":
+		cfg.MaxBatch = *maxBatch
+	case "drain-timeout":
+		cfg.drainTimeout = *drainTimeout
+	}
+
+	return
+}
+
+// replaceHost is a function that replaces the host of the given host+port, or
+// of the given fallback one if it's empty, i.e. if the listener is disabled.
+func replaceHost(addr, host, fallback string) (string, error) {
+	if len(addr) == 0 {
+		addr = fallback
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// replacePort is a function that replaces the port of the given host+port, or
+// of the given fallback one if it's empty, i.e. if the listener is disabled.
+func replacePort(addr, port, fallback string) (string, error) {
+	if len(addr) == 0 {
+		addr = fallback
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// reloadMapsOnSignal is a function that reloads the proxy's maps every time
+// the process receives SIGHUP.
+func reloadMapsOnSignal(p *proxy.Proxy) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		if err := p.ReloadMaps(); err != nil {
+			log.Printf("ERROR: Failed to reload compression maps, keeping the previous ones: %v", err)
+		}
+	}
 }
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+)
+
+// adminMux is a function that returns the handler for the admin endpoints,
+// which are:
+//   * POST /reload: reloads the compression maps
+//   * GET /metrics: serves the metrics in the Prometheus text format
+func (p *Proxy) adminMux() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := p.ReloadMaps(); err != nil {
+			log.Printf("ERROR: Failed to reload compression maps, keeping the previous ones: %v", err)
+			writeMatrixError(w, http.StatusBadRequest, "M_UNKNOWN", err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string][]string{
+			"versions": p.loadedMaps().versions(),
+		})
+	})
+
+	mux.HandleFunc("/metrics", p.serveMetrics)
+
+	return mux
+}
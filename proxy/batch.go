@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/matrix-org/go-coap"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// batchPath is the path proxies send batches of federation transactions on. It
+// can't be mistaken for a compressed route as it isn't a base 32 integer.
+const batchPath = "/_batch"
+
+// batchCapability is the value of the LocationQuery option a proxy answers the
+// maps handshake with to tell it accepts batches of transactions.
+const batchCapability = "batch"
+
+// batchTxnsKey is the key of a batch's payload which lists its transactions.
+// Each entry holds a transaction's ID, its fields other than its PDUs and EDUs,
+// and how many of the batch's PDUs and EDUs are its, in the same order.
+const batchTxnsKey = "XTX"
+
+// batchTxnFailedStatus is the status a transaction from a batch is answered
+// with if it couldn't be sent to the homeserver, or if its response couldn't be
+// read, so the sending proxy can tell it apart from an error of the homeserver.
+const batchTxnFailedStatus = http.StatusBadGateway
+
+// batchedTransaction is a struct that represents a federation transaction
+// waiting in a batch. done is closed once its response is in.
+type batchedTransaction struct {
+	txnID string
+	u     *url.URL
+	body  map[interface{}]interface{}
+	done  chan struct{}
+
+	resBody    interface{}
+	statusCode coap.COAPCode
+	err        error
+}
+
+// transactionBatch is a struct that holds the transactions from a homeserver
+// to a proxy which are waiting to be sent together.
+type transactionBatch struct {
+	target string
+	origin string
+	prio   priority
+	txns   []*batchedTransaction
+	timer  *time.Timer
+}
+
+// batcher is a struct that holds the open batches, by proxy and origin.
+type batcher struct {
+	p *Proxy
+
+	mut  sync.Mutex
+	open map[string]*transactionBatch
+}
+
+// newBatcher is a function that returns a batcher with no open batch, or nil if
+// batching is disabled.
+func newBatcher(p *Proxy) *batcher {
+	if p.opts.BatchWindow == 0 {
+		return nil
+	}
+
+	return &batcher{
+		p:    p,
+		open: make(map[string]*transactionBatch),
+	}
+}
+
+// add is a function that adds the transaction with the given ID, URL and body
+// from the given origin to the batch of the given proxy, and waits for its
+// response. The batch is sent once BatchWindow has elapsed since it was opened,
+// or once it holds MaxBatch transactions.
+func (b *batcher) add(
+	target, origin, txnID string, u *url.URL, body interface{}, prio priority,
+) (resBody interface{}, statusCode coap.COAPCode, err error) {
+	bodyMap, ok := body.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("Transaction isn't a JSON object")
+	}
+
+	txn := &batchedTransaction{
+		txnID: txnID,
+		u:     u,
+		body:  bodyMap,
+		done:  make(chan struct{}),
+	}
+
+	key := target + " " + origin
+
+	b.mut.Lock()
+	batch, ok := b.open[key]
+	if !ok {
+		batch = &transactionBatch{target: target, origin: origin, prio: prio}
+		b.open[key] = batch
+		batch.timer = time.AfterFunc(b.p.opts.BatchWindow, func() { b.close(key, batch) })
+	}
+	batch.txns = append(batch.txns, txn)
+	full := len(batch.txns) >= b.p.opts.MaxBatch
+	b.mut.Unlock()
+
+	common.Debugf("Batching transaction %s to %s", txnID, target)
+
+	if full {
+		batch.timer.Stop()
+		b.close(key, batch)
+	}
+
+	<-txn.done
+	return txn.resBody, txn.statusCode, txn.err
+}
+
+// close is a function that stops the given batch from taking transactions and
+// sends it, unless that's already been done.
+func (b *batcher) close(key string, batch *transactionBatch) {
+	b.mut.Lock()
+	if b.open[key] != batch {
+		b.mut.Unlock()
+		return
+	}
+	delete(b.open, key)
+	b.mut.Unlock()
+
+	go b.p.sendBatch(batch)
+}
+
+// sendBatch is a function that sends the transactions of the given batch to its
+// proxy in a single request, and hands their responses to the requests waiting
+// on them. A batch of a single transaction, or to a proxy which doesn't accept
+// batches, is sent as separate transactions.
+func (p *Proxy) sendBatch(batch *transactionBatch) {
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), "transaction_batch")
+	defer span.Finish()
+
+	span.SetTag("batch.size", len(batch.txns))
+
+	c, err := p.conns.get(batch.target)
+	if err != nil {
+		batch.fail(&unreachableError{err})
+		return
+	}
+	defer c.release()
+
+	if len(batch.txns) == 1 || !c.batchable {
+		for _, txn := range batch.txns {
+			match, _ := c.maps.identifyRoute(txn.u.Path, "PUT")
+			path := coapPathFor(c, txn.u, match, "")
+			txn.resBody, txn.statusCode, txn.err = p.sendCoAPRequest(
+				ctx, c, batch.target, "PUT", path, "send_transaction", batch.prio, txn.body, &batch.origin,
+			)
+			close(txn.done)
+		}
+		return
+	}
+
+	common.Debugf("Sending a batch of %d transactions to %s", len(batch.txns), batch.target)
+
+	resBody, statusCode, err := p.sendCoAPRequest(
+		ctx, c, batch.target, "PUT", batchPath, "send_transaction", batch.prio, batch.merge(), &batch.origin,
+	)
+	if err == nil && statusCode != coap.Content {
+		err = fmt.Errorf("Remote proxy answered the batch with %s", statusCode)
+	}
+
+	var results []interface{}
+	if err == nil {
+		var ok bool
+		if results, ok = resBody.([]interface{}); !ok || len(results) != len(batch.txns) {
+			err = errors.New("Remote proxy answered the batch with an invalid payload")
+		}
+	}
+
+	if err != nil {
+		handleErr(err, span)
+		batch.fail(err)
+		return
+	}
+
+	for i, txn := range batch.txns {
+		res, ok := results[i].([]interface{})
+		if !ok || len(res) != 2 {
+			txn.err = errors.New("Remote proxy answered the transaction with an invalid result")
+		} else if code, ok := toInt(res[0]); !ok {
+			txn.err = errors.New("Remote proxy answered the transaction with an invalid status")
+		} else {
+			txn.statusCode = statusHTTPToCoAP(code)
+			txn.resBody = res[1]
+		}
+		close(txn.done)
+	}
+}
+
+// merge is a function that returns the payload of the request sending the
+// batch, which holds the PDUs and the EDUs of all of its transactions so they
+// get compressed together.
+func (batch *transactionBatch) merge() map[interface{}]interface{} {
+	pdus := make([]interface{}, 0)
+	edus := make([]interface{}, 0)
+	txns := make([]interface{}, 0, len(batch.txns))
+
+	for _, txn := range batch.txns {
+		txnPDUs, _ := txn.body["pdus"].([]interface{})
+		txnEDUs, _ := txn.body["edus"].([]interface{})
+		pdus = append(pdus, txnPDUs...)
+		edus = append(edus, txnEDUs...)
+
+		rest := make(map[interface{}]interface{})
+		for k, v := range txn.body {
+			if k != "pdus" && k != "edus" {
+				rest[k] = v
+			}
+		}
+
+		txns = append(txns, []interface{}{txn.txnID, rest, len(txnPDUs), len(txnEDUs)})
+	}
+
+	return map[interface{}]interface{}{
+		"pdus":       pdus,
+		"edus":       edus,
+		batchTxnsKey: txns,
+	}
+}
+
+// fail is a function that fails every transaction of the batch with the given
+// error.
+func (batch *transactionBatch) fail(err error) {
+	for _, txn := range batch.txns {
+		txn.err = err
+		close(txn.done)
+	}
+}
+
+// serveTransactionBatch is a function that serves a batch of transactions from
+// another proxy, by sending them one after the other to the homeserver, and
+// answers it with their status codes and response bodies.
+func (p *Proxy) serveTransactionBatch(
+	ctx context.Context, w coap.ResponseWriter, req *coap.Request, body interface{}, ms *mapSet, usesDict bool,
+	serverSpan opentracing.Span,
+) {
+	var origin string
+	if s, ok := req.Msg.Option(coap.LocationPath).(string); ok {
+		origin = s
+	}
+	ext.PeerHostname.Set(serverSpan, origin)
+
+	txns, err := splitBatch(ms.compressor.DecompressTransaction(body))
+	if err != nil {
+		handleDecodeErr(w, newDecodeError(coap.BadRequest, "Invalid batch: %v", err), ms, serverSpan)
+		return
+	}
+
+	common.Debugf("CoAP - %X: Got a batch of %d transactions", req.Msg.Token(), len(txns))
+	serverSpan.SetTag("batch.size", len(txns))
+
+	results := make([]interface{}, 0, len(txns))
+	for _, txn := range txns {
+		path := "/_matrix/federation/v1/send/" + url.PathEscape(txn.txnID)
+
+		pl, statusCode, err := p.sendHTTPRequest(ctx, "PUT", path, json.Encode(txn.body), origin)
+		if err != nil {
+			log.Printf("ERROR: Failed to send transaction %s from a batch: %v", txn.txnID, err)
+			results = append(results, []interface{}{batchTxnFailedStatus, nil})
+			continue
+		}
+
+		var resBody interface{}
+		if len(pl) > 0 {
+			if resBody, err = decodeJSON(pl); err != nil {
+				log.Printf("ERROR: Failed to decode response to transaction %s: %v", txn.txnID, err)
+				results = append(results, []interface{}{batchTxnFailedStatus, nil})
+				continue
+			}
+		}
+
+		if p.opts.DropErrorMessages && statusCode >= 400 {
+			dropErrorMessage(resBody)
+		}
+
+		results = append(results, []interface{}{statusCode, resBody})
+	}
+
+	pl, err := p.encodeResponseBody(results, 200, "send_transaction", ms, usesDict)
+	if err != nil {
+		handleErr(err, serverSpan)
+		return
+	}
+
+	w.SetCode(coap.Content)
+	w.SetContentFormat(coap.AppOctets)
+	if _, err = w.Write(pl); err != nil {
+		handleErr(err, serverSpan)
+	}
+}
+
+// splitBatch is a function that splits the payload of a batch back into its
+// transactions, which are returned with their ID.
+func splitBatch(val interface{}) ([]*batchedTransaction, error) {
+	bodyMap, ok := val.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Payload isn't a map")
+	}
+
+	entries, ok := bodyMap[batchTxnsKey].([]interface{})
+	if !ok {
+		return nil, errors.New("Transactions list is missing")
+	}
+
+	pdus, _ := bodyMap["pdus"].([]interface{})
+	edus, _ := bodyMap["edus"].([]interface{})
+
+	txns := make([]*batchedTransaction, 0, len(entries))
+	for i, e := range entries {
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 4 {
+			return nil, fmt.Errorf("Transaction #%d isn't a list of 4 items", i)
+		}
+
+		txnID, ok := entry[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Transaction #%d has no ID", i)
+		}
+
+		rest, ok := entry[1].(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Transaction #%d has no fields", i)
+		}
+
+		nPDUs, ok1 := toInt(entry[2])
+		nEDUs, ok2 := toInt(entry[3])
+		if !ok1 || !ok2 || nPDUs < 0 || nEDUs < 0 || nPDUs > len(pdus) || nEDUs > len(edus) {
+			return nil, fmt.Errorf("Transaction #%d has invalid PDU or EDU counts", i)
+		}
+
+		body := rest
+		body["pdus"], pdus = pdus[:nPDUs], pdus[nPDUs:]
+		body["edus"], edus = edus[:nEDUs], edus[nEDUs:]
+
+		txns = append(txns, &batchedTransaction{txnID: txnID, body: body})
+	}
+
+	return txns, nil
+}
+
+// toInt is a function that returns the value of the given integer decoded from
+// CBOR, which can be signed or unsigned.
+func toInt(val interface{}) (int, bool) {
+	switch v := val.(type) {
+	case uint64:
+		return int(v), true
+	case int64:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// cacheKey is a struct that identifies a cached response: the proxy it comes
+// from, the version of the maps the request's path was compressed with, that
+// path, which starts with the route ID and includes the access token, and the
+// server the request came from over federation, if any, as the response can
+// depend on who's asking.
+type cacheKey struct {
+	target  string
+	version string
+	path    string
+	origin  string
+}
+
+// cacheEntry is a struct that holds a cached response, with its raw payload
+// as received from the other proxy.
+type cacheEntry struct {
+	key     cacheKey
+	code    coap.COAPCode
+	payload []byte
+	etag    []byte
+	expires time.Time
+}
+
+// fresh is a function that returns whether the cached response can still be
+// used without checking with the other proxy whether it changed.
+func (e cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// responseCache is a struct that holds the responses to GET requests the other
+// proxies allowed us to cache, evicting the least recently used ones once
+// their payloads take more than maxBytes bytes.
+type responseCache struct {
+	mut      sync.Mutex
+	maxBytes int
+	size     int
+	lru      *list.List // lru holds the *cacheEntry, from the most recently used
+	byKey    map[cacheKey]*list.Element
+}
+
+// newResponseCache is a function that returns an empty responseCache holding at
+// most maxBytes bytes of payloads, or nil if maxBytes is 0, which disables the
+// cache.
+func newResponseCache(maxBytes int) *responseCache {
+	if maxBytes == 0 {
+		return nil
+	}
+
+	return &responseCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		byKey:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// lookup is a function that returns the response cached with the given key,
+// whether it's still fresh or not.
+func (rc *responseCache) lookup(key cacheKey) (cacheEntry, bool) {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+
+	el, ok := rc.byKey[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	rc.lru.MoveToFront(el)
+	return *el.Value.(*cacheEntry), true
+}
+
+// store is a function that caches the given response with the given key for
+// maxAge, replacing any previous one. Responses larger than the whole cache
+// aren't kept.
+func (rc *responseCache) store(key cacheKey, code coap.COAPCode, payload []byte, etag []byte, maxAge time.Duration) {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+
+	rc.removeLocked(key)
+
+	if len(payload) > rc.maxBytes {
+		return
+	}
+
+	rc.byKey[key] = rc.lru.PushFront(&cacheEntry{
+		key:     key,
+		code:    code,
+		payload: payload,
+		etag:    etag,
+		expires: time.Now().Add(maxAge),
+	})
+	rc.size += len(payload)
+
+	for rc.size > rc.maxBytes {
+		rc.removeLocked(rc.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// refresh is a function that makes the response cached with the given key
+// fresh for another maxAge, if it's still cached with the given ETag.
+func (rc *responseCache) refresh(key cacheKey, etag []byte, maxAge time.Duration) {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+
+	el, ok := rc.byKey[key]
+	if !ok {
+		return
+	}
+
+	e := el.Value.(*cacheEntry)
+	if bytes.Equal(e.etag, etag) {
+		e.expires = time.Now().Add(maxAge)
+	}
+}
+
+// remove is a function that forgets the response cached with the given key,
+// if any.
+func (rc *responseCache) remove(key cacheKey) {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+
+	rc.removeLocked(key)
+}
+
+// removeLocked is a function that forgets the response cached with the given
+// key, if any. It must be called with the cache's lock held.
+func (rc *responseCache) removeLocked(key cacheKey) {
+	el, ok := rc.byKey[key]
+	if !ok {
+		return
+	}
+
+	rc.lru.Remove(el)
+	delete(rc.byKey, key)
+	rc.size -= len(el.Value.(*cacheEntry).payload)
+}
+
+// responseETag is a function that returns the ETag of a response from the
+// homeserver with the given status code and body. It's computed from the JSON
+// body rather than the CoAP payload, which isn't the same every time for the
+// same body as the keys of CBOR maps aren't encoded in a set order.
+func responseETag(statusCode int, body []byte) []byte {
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, uint16(statusCode))
+	_, _ = h.Write(body)
+	return h.Sum(nil)
+}
+
+// setCacheOptions is a function that lets the proxy receiving the given
+// response cache it for maxAge seconds, and revalidate it with the given ETag.
+func setCacheOptions(res coap.Message, etag []byte, maxAge int) {
+	res.SetOption(coap.ETag, etag)
+	res.SetOption(coap.MaxAge, uint32(maxAge))
+}
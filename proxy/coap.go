@@ -0,0 +1,619 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+	"github.com/matrix-org/coap-proxy/types"
+
+	"github.com/matrix-org/go-coap"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	olog "github.com/opentracing/opentracing-go/log"
+)
+
+// serveCOAP is a function that listens for CoAP requests and responds accordingly.
+// It:
+//   * Takes in a CoAP request
+//   * Decompresses and CBOR decodes the payload if there is one
+//   * Decompresses the request path and query parameters
+//   * Creates an HTTP request with carried over and decompressed headers, path, body etc.
+//   * Sends the HTTP request to an attached Homeserver, retrieves the response
+//   * Compresses the response
+//   * Returns it over CoAP to the requester
+func (p *Proxy) serveCOAP(w coap.ResponseWriter, req *coap.Request) {
+	ctx := context.Background()
+
+	m := req.Msg
+
+	// Observations of syncs get cancelled with a non-confirmable message.
+	if obs, ok := m.Option(coap.Observe).(uint32); ok && obs == 1 && !m.IsConfirmable() {
+		p.observers.deregister(req.Client.RemoteAddr(), m.Token())
+		return
+	}
+
+	if !m.IsConfirmable() {
+		log.Printf("Got unconfirmable message")
+		return
+	}
+
+	if "/"+m.PathString() == mapsHandshakePath {
+		p.serveMapsHandshake(w, req)
+		return
+	}
+
+	// Requests from proxies which have one of the generations of our maps use
+	// its dictionary, and we need to use the same generation to answer them.
+	// Otherwise we can only talk to them if we're allowed to fall back to not
+	// using any.
+	// The payload says which generation it was compressed with, otherwise the
+	// transport remembers which one the request was.
+	tag, _ := p.serverTransport.TokenTag(m.Token())
+	if pl := m.Payload(); len(pl) > 0 {
+		tag, _, _ = types.PayloadTag(pl)
+	}
+	ms := p.loadedMaps().byTag(tag)
+	usesDict := ms != nil
+	if !usesDict {
+		ms = p.loadedMaps().newest()
+	}
+
+	if !usesDict && p.opts.MapsMismatch == MapsMismatchRefuse {
+		log.Printf("Refusing request from %s which doesn't use our maps", req.Client.RemoteAddr())
+		w.SetCode(coap.PreconditionFailed)
+		_, _ = w.Write(nil)
+		return
+	}
+
+	pl := m.Payload()
+
+	var serverSpan opentracing.Span
+	if max := p.opts.MaxMessageSize; max > 0 && len(pl) > max {
+		err := newDecodeError(coap.BadRequest, "Payload of %d bytes is larger than the limit of %d bytes", len(pl), max)
+		handleDecodeErr(w, err, ms, serverSpan)
+		return
+	}
+
+	var body interface{}
+	if len(pl) > 0 {
+		// Decompress and decode the payload body if it exists
+		var err error
+		if pl, err = ms.compressor.DecompressPayload(pl); err != nil {
+			err = newDecodeError(coap.BadRequest, "Failed to decompress payload: %v", err)
+			handleDecodeErr(w, err, ms, serverSpan)
+			return
+		}
+		if body, err = decodeCBOR(pl); err != nil {
+			err = newDecodeError(coap.BadRequest, "Failed to decode payload: %v", err)
+			handleDecodeErr(w, err, ms, serverSpan)
+			return
+		}
+
+		// The remote proxy only substitutes common keys and values if it uses
+		// our maps
+		if usesDict {
+			body = ms.compressor.DecompressBody(body)
+		}
+
+		var carrier interface{}
+		if bodyMap, ok := body.(map[interface{}]interface{}); ok {
+			carrier = bodyMap["XJG"]
+			delete(bodyMap, "XJG")
+		}
+
+		if carrierBytes, ok := carrier.([]byte); ok {
+			common.Debugf("XFG header received len %d", len(carrierBytes))
+			wireContext, err := opentracing.GlobalTracer().Extract(
+				opentracing.Binary,
+				bytes.NewReader(carrierBytes),
+			)
+
+			if err != nil {
+				common.Debugf("Failed to extract wire context %v", err)
+			}
+
+			serverSpan = opentracing.StartSpan(
+				"coap-server",
+				ext.RPCServerOption(wireContext),
+			)
+
+			defer serverSpan.Finish()
+
+			ctx = opentracing.ContextWithSpan(ctx, serverSpan)
+		}
+	}
+
+	if serverSpan == nil {
+		serverSpan, ctx = opentracing.StartSpanFromContext(ctx, "coap-server")
+		defer serverSpan.Finish()
+
+		ext.SpanKindRPCServer.Set(serverSpan)
+	}
+
+	if "/"+m.PathString() == batchPath {
+		p.serveTransactionBatch(ctx, w, req, body, ms, usesDict, serverSpan)
+		return
+	}
+
+	path := m.PathString()
+
+	common.Debugf("CoAP - %X: Got request on path %s", req.Msg.Token(), path)
+
+	var query string
+	s := strings.Split(path, "?")
+	if len(s) > 1 {
+		query = s[1]
+		path = s[0]
+	} else {
+		query = ""
+	}
+
+	// Get routeID and path arguments from request path
+	args, trailingSlash, routeID, err := argsAndRouteFromPath(path)
+	if err == nil && (routeID < 0 || routeID >= len(ms.routes)) {
+		err = newDecodeError(coap.BadOption, "Unknown route ID %d", routeID)
+		handleDecodeErr(w, err, ms, serverSpan)
+		return
+	}
+
+	// Get decompressed path and query parameters from the request
+	var method, routeName string
+	var maxAge int
+	if err == nil {
+		r := ms.routes[routeID]
+
+		common.Debugf(
+			"CoAP - %X: Got request on route #%d (%s %s)\n",
+			req.Msg.Token(), routeID, strings.ToUpper(r.Method), r.Path,
+		)
+
+		path, err = ms.genExpandedPath(path, args, query, trailingSlash, routeID)
+		if err != nil {
+			handleDecodeErr(w, err, ms, serverSpan)
+			return
+		}
+
+		common.Debugf("CoAP - %X: Got request on URL %s", req.Msg.Token(), path)
+
+		method = r.Method
+		routeName = r.Name
+		maxAge = r.MaxAge
+	} else {
+		c := req.Msg.Code()
+		if c >= coap.GET && c <= coap.DELETE {
+			method = c.String()
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+
+			path, err = ms.genExpandedPath(path, args, query, trailingSlash, -1)
+			if err != nil {
+				handleDecodeErr(w, err, ms, serverSpan)
+				return
+			}
+		} else {
+			err = newDecodeError(coap.MethodNotAllowed, "Wrong method code: %s", c.String())
+			handleDecodeErr(w, err, ms, serverSpan)
+			return
+		}
+
+		common.Debugf(
+			"CoAP - %X: Got request on unknown route %s %s",
+			req.Msg.Token(), method, path,
+		)
+	}
+
+	// Syncs observed by the remote proxy are done on our own, not forwarded
+	if routeName == "sync" && p.opts.ObserveSync {
+		if u, err := url.Parse(path); err == nil && len(u.Query().Get(observeMarker)) > 0 {
+			p.serveSyncObservation(w, req, u, ms, usesDict)
+			return
+		}
+	}
+
+	common.Debugf("CoAP - %X: Sending HTTP request", req.Msg.Token())
+	common.Debug("routeName", routeName)
+	common.Debugf("COAP options %v", req.Msg.AllOptions())
+
+	// Encode the CBOR-decoded body into JSON
+	if len(pl) > 0 {
+		if routeName == "send_transaction" {
+			body = ms.compressor.DecompressTransaction(body)
+		}
+		pl = json.Encode(body)
+	}
+
+	// XXX: HACK: Use the coap library's MaxAge option to store origin (due to the
+	// lib ignoring unknown options). Do not rely on this to remain functional across
+	// lib upgrades.
+	originOpt := m.Option(coap.LocationPath)
+	common.Debugf("opt: %v", originOpt)
+
+	// TODO: Handle fs-specific stuff
+	var origin string
+	if s, ok := originOpt.(string); ok {
+		origin = s
+	}
+
+	ext.PeerHostname.Set(serverSpan, origin)
+
+	// Send an HTTP request to a homeserver and receive a response
+	pl, statusCode, err := p.sendHTTPRequest(
+		ctx,
+		method,
+		path,
+		pl,
+		origin,
+	)
+	if err != nil {
+		handleErr(err, serverSpan)
+		return
+	}
+
+	common.Debugf("CoAP - %X: Got status %d", req.Msg.Token(), statusCode)
+
+	// Let the remote proxy cache successful responses on routes which allow
+	// it, and only tell it its cached response is still valid if it is
+	var etag []byte
+	if maxAge > 0 && statusCode == 200 {
+		etag = responseETag(statusCode, pl)
+
+		if reqETag, ok := m.Option(coap.ETag).([]byte); ok && bytes.Equal(reqETag, etag) {
+			common.Debugf("CoAP - %X: Response hasn't changed", req.Msg.Token())
+
+			res := w.NewResponse(coap.Valid)
+			setCacheOptions(res, etag, maxAge)
+			if err = w.WriteMsg(res); err != nil {
+				handleErr(err, serverSpan)
+			}
+			return
+		}
+	}
+
+	common.Debugf("CoAP - %X: Sending response", req.Msg.Token())
+
+	// Convert the receive HTTP status code to a CoAP one and add to response
+	w.SetCode(statusHTTPToCoAP(statusCode))
+
+	// Re-encode the JSON body into CBOR and write out
+	if len(pl) > 0 {
+		if pl, err = p.encodeResponseBody(json.Decode(pl), statusCode, routeName, ms, usesDict); err != nil {
+			handleErr(err, serverSpan)
+			return
+		}
+
+		if etag != nil {
+			res := w.NewResponse(statusHTTPToCoAP(statusCode))
+			setCacheOptions(res, etag, maxAge)
+			res.SetOption(coap.ContentFormat, coap.AppOctets)
+			res.SetPayload(pl)
+			err = w.WriteMsg(res)
+		} else {
+			w.SetContentFormat(coap.AppOctets)
+			_, err = w.Write(pl)
+		}
+		if err != nil {
+			handleErr(err, serverSpan)
+			return
+		}
+	}
+}
+
+// encodeResponseBody is a function that encodes the body of a response from
+// the homeserver with the given status code on the given route to send it over
+// CoAP, using the given maps' dictionary if usesDict is true.
+func (p *Proxy) encodeResponseBody(
+	resBody interface{}, statusCode int, routeName string, ms *mapSet, usesDict bool,
+) ([]byte, error) {
+	if p.opts.DropErrorMessages && statusCode >= 400 {
+		dropErrorMessage(resBody)
+	}
+
+	if usesDict {
+		// Sync responses are full of identifiers, whose server names the
+		// remote proxy knows too if it uses our maps
+		if routeName == "sync" {
+			resBody = ms.compressor.InternServerNames(resBody)
+		}
+
+		return ms.compressor.CompressPayload(cbor.Encode(ms.compressor.CompressBody(resBody)))
+	}
+
+	return ms.compressor.CompressPayloadNoDict(cbor.Encode(resBody))
+}
+
+// handleDecodeErr is a function that handles an error which occurred while
+// decoding a request. If it's a decodeError, the request is answered with the
+// error's code and a Matrix error describing it, compressed without any
+// dictionary as it may well be the cause of the error.
+func handleDecodeErr(w coap.ResponseWriter, err error, ms *mapSet, serverSpan opentracing.Span) {
+	handleErr(err, serverSpan)
+
+	decErr, ok := err.(*decodeError)
+	if !ok {
+		return
+	}
+
+	pl, err := ms.compressor.CompressPayloadNoDict(cbor.Encode(map[string]string{
+		"errcode": "M_UNRECOGNIZED",
+		"error":   decErr.msg,
+	}))
+	if err != nil {
+		handleErr(err, serverSpan)
+		return
+	}
+
+	w.SetCode(decErr.code)
+	w.SetContentFormat(coap.AppOctets)
+
+	if _, err = w.Write(pl); err != nil {
+		handleErr(err, serverSpan)
+	}
+}
+
+// sendCoAPRequest is a function that sends a CoAP request to another instance
+// of the CoAP proxy over the given connection. It returns the decoded body of
+// the response, which is nil if it doesn't have a payload.
+func (p *Proxy) sendCoAPRequest(
+	ctx context.Context, c *openConn, target, method, path string, routeName string,
+	prio priority, body interface{}, origin *string,
+) (resBody interface{}, statusCode coap.COAPCode, err error) {
+	// Setup OpenTracing
+	var clientSpan opentracing.Span
+	clientSpan, ctx = opentracing.StartSpanFromContext(ctx, "coap-client")
+	defer clientSpan.Finish()
+
+	ext.SpanKindRPCClient.Set(clientSpan)
+
+	clientSpan.SetTag("coap.path", path)
+	clientSpan.SetTag("coap.method", method)
+
+	common.Debugf("Proxying request to %s", target)
+
+	// Record the destination in the trace
+	hostAddr := strings.Split(target, ":")[0]
+	ext.PeerHostname.Set(clientSpan, hostAddr)
+	ext.PeerAddress.Set(clientSpan, target)
+
+	if p.opts.Tracing {
+		carrier := &bytes.Buffer{}
+		_ = opentracing.GlobalTracer().Inject(
+			clientSpan.Context(),
+			opentracing.Binary,
+			carrier,
+		)
+
+		// Add a tracing header to the request
+		if bodyMap, ok := body.(map[interface{}]interface{}); ok {
+			carrierBytes := carrier.Bytes()
+
+			common.Debugf("XFG header len: %d", len(carrierBytes))
+
+			clientSpan.LogFields(olog.Int("jaeger-bytes", len(carrierBytes)))
+			bodyMap["XJG"] = carrierBytes
+		}
+
+	}
+
+	// Map for translating HTTP method codes to CoAP
+	methodCodes := map[string]coap.COAPCode{
+		"GET":    coap.GET,
+		"POST":   coap.POST,
+		"PUT":    coap.PUT,
+		"DELETE": coap.DELETE,
+	}
+
+	var bodyBytes []byte
+	if body != nil {
+		// Compress transaction if this a federation transaction request, only
+		// if the remote proxy has the same server names registry as us
+		if routeName == "send_transaction" && c.compat == mapsMatch {
+			body = c.maps.compressor.CompressTransaction(body)
+			common.DumpPayload("Encoded transaction", body)
+		}
+
+		// Substitute common keys and values, only if the remote proxy has the
+		// same maps as us
+		if c.compat == mapsMatch {
+			body = c.maps.compressor.CompressBody(body)
+		}
+
+		// Encode body as CBOR
+		bodyBytes = cbor.Encode(body)
+
+		common.DumpPayload("Encoded body", bodyBytes)
+
+		// Compress body, using the dictionary only if the remote proxy has the
+		// same maps as us
+		if c.compat == mapsMatch {
+			bodyBytes, err = c.maps.compressor.CompressPayload(bodyBytes)
+		} else {
+			bodyBytes, err = c.maps.compressor.CompressPayloadNoDict(bodyBytes)
+		}
+		if err != nil {
+			ext.Error.Set(clientSpan, true)
+			clientSpan.LogFields(olog.Error(err))
+			return
+		}
+	}
+
+	// Answer GET requests from the cache while the remote proxy allows it
+	var key cacheKey
+	var cached cacheEntry
+	var hasCached bool
+	cacheable := p.cache != nil && strings.ToUpper(method) == "GET" && c.compat == mapsMatch
+	if cacheable {
+		key = cacheKey{target: target, version: c.maps.version, path: path}
+		if origin != nil {
+			key.origin = *origin
+		}
+		if cached, hasCached = p.cache.lookup(key); hasCached && cached.fresh(time.Now()) {
+			common.Debugf("Answering from the cache")
+			clientSpan.SetTag("coap.cache", "hit")
+
+			resBody, err = c.decodePayload(cached.payload, routeName)
+			return resBody, cached.code, err
+		}
+	}
+
+	common.Debugf("Sending %d bytes in compressed payload", len(bodyBytes))
+	clientSpan.LogFields(olog.Int("payload-bytes", len(bodyBytes)))
+
+	// Create a new CoAP request
+	req := c.NewMessage(coap.MessageParams{
+		Type:      coap.Confirmable,
+		Code:      methodCodes[strings.ToUpper(method)],
+		MessageID: uint16(r1.Intn(100000)),
+		Token:     randSlice(2),
+		Payload:   bodyBytes,
+	})
+
+	if origin != nil {
+		// XXX: HACK: Use the coap library's MaxAge option to store origin (due to the
+		// lib ignoring unknown options). Do not rely on this to remain functional across
+		// lib upgrades.
+		req.SetOption(coap.LocationPath, *origin)
+	}
+
+	// Only get the response back if it changed since we cached it
+	if hasCached {
+		req.SetOption(coap.ETag, cached.etag)
+	}
+
+	// This option should be set last, to aid compression of the packet
+	req.SetOption(coap.ContentFormat, coap.AppOctets)
+
+	if len(path) > 250 {
+		// We can't send long paths, so lets bail out here
+		err = errors.New("Path too long: " + path)
+		return
+	}
+
+	req.SetPathString(path)
+
+	log.Printf("HTTP: Sending CoAP request with token %X (path: %v)", req.Token(), path)
+
+	// Wait for the link to the remote proxy to have room for the request
+	l := p.links.get(target, c.settings.congestion)
+	if err = l.acquire(ctx, len(bodyBytes), prio); err != nil {
+		ext.Error.Set(clientSpan, true)
+		clientSpan.LogFields(olog.Error(err))
+		return
+	}
+	outcome, resSize := exchangeFailed, 0
+	defer func() { l.release(outcome, resSize) }()
+
+	// Send the CoAP request and receive a response
+	common.Debugf("opts %v", req.AllOptions())
+	res, err := c.Exchange(req)
+
+	// Check for errors
+	if err != nil {
+		log.Printf("Closing CoAP connection because of error: %v", err)
+
+		// Stop retransmitting the request now that we've given up on it.
+		c.cancelExchange(req)
+
+		compat := c.compat
+		if c, err = p.conns.reset(target, c); err != nil {
+			err = &unreachableError{err}
+			return
+		}
+		defer c.release()
+
+		// The path and payload have been compressed for the previous
+		// connection, so we can't send them if the maps negotiation had
+		// another outcome this time.
+		if c.compat != compat {
+			err = errors.New("Remote proxy's maps changed, not retrying")
+			return
+		}
+
+		if res, err = c.Exchange(req); err != nil {
+			c.cancelExchange(req)
+			ext.Error.Set(clientSpan, true)
+			clientSpan.LogFields(olog.Error(err))
+			log.Printf("HTTP failed to exchange coap: %v", err)
+			err = &unreachableError{err}
+			return
+		}
+	}
+
+	// Receive and decompress the response payload
+	rawPayload := res.Payload()
+	resSize = len(rawPayload)
+	if c.recordRTT(c.transport.SentMessages(req.Token()), routeName) {
+		outcome = exchangeRetransmitted
+	} else {
+		outcome = exchangeAnswered
+	}
+	clientSpan.LogFields(olog.Int("response-payload-bytes", len(rawPayload)))
+
+	if max := c.settings.maxMessageSize; max > 0 && len(rawPayload) > max {
+		err = fmt.Errorf("Response payload of %d bytes is larger than the limit of %d bytes", len(rawPayload), max)
+		ext.Error.Set(clientSpan, true)
+		clientSpan.LogFields(olog.Error(err))
+		return
+	}
+
+	common.Debugf("HTTP: Got response to CoAP request %X with %d bytes in response payload", res.Token(), len(rawPayload))
+
+	// Keep track of the last successfully received message for connection timeout purposes
+	c.touch()
+
+	statusCode = res.Code()
+	if cacheable {
+		maxAge, _ := res.Option(coap.MaxAge).(uint32)
+		etag, _ := res.Option(coap.ETag).([]byte)
+
+		switch {
+		case statusCode == coap.Valid && hasCached && bytes.Equal(etag, cached.etag):
+			common.Debugf("Cached response is still valid")
+			clientSpan.SetTag("coap.cache", "revalidated")
+
+			p.cache.refresh(key, etag, time.Duration(maxAge)*time.Second)
+			rawPayload, statusCode = cached.payload, cached.code
+		case statusCode == coap.Content && maxAge > 0:
+			p.cache.store(key, statusCode, rawPayload, etag, time.Duration(maxAge)*time.Second)
+		default:
+			p.cache.remove(key)
+		}
+	}
+
+	resBody, err = c.decodePayload(rawPayload, routeName)
+	return resBody, statusCode, err
+}
+
+// decodePayload is a function that decompresses and decodes the payload of a
+// response on the given route received on the connection. It returns nil if
+// the payload is empty.
+func (c *openConn) decodePayload(rawPayload []byte, routeName string) (interface{}, error) {
+	pl, err := c.maps.compressor.DecompressPayload(rawPayload)
+	if err != nil || len(pl) == 0 {
+		return nil, err
+	}
+
+	body, err := decodeCBOR(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	// The remote proxy substituted common keys and values if it compressed
+	// the payload with our maps' dictionary
+	if rawPayload[0] != types.NoDictTag {
+		body = c.maps.compressor.DecompressBody(body)
+
+		// Interned server names are tagged, so they can be restored
+		// whatever the route, and the remote proxy's name for it
+		body = c.maps.compressor.RestoreServerNames(body)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+)
+
+// errLinkCongested is the error returned when a request can't be queued
+// because too many are already waiting to be sent to the same proxy.
+var errLinkCongested = errors.New("Too many requests are waiting to be sent to the remote proxy")
+
+// CongestionOptions is a struct that holds how to limit the traffic sent to
+// another proxy. Requests which can't be sent straight away wait in a queue.
+type CongestionOptions struct {
+	// MaxOutstanding is the most exchanges which can be in flight with a peer
+	// at once (CoAP's NSTART), 0 for no limit. The congestion window starts
+	// there, is halved whenever an exchange fails or needs retransmissions,
+	// and grows back by one every window's worth of exchanges which don't.
+	MaxOutstanding int
+	// BytesPerSecond is the rate at which payload bytes can be exchanged with
+	// a peer, 0 for no limit. Bursts of up to a second's worth are allowed.
+	BytesPerSecond int
+	// MaxQueue is how many requests can wait to be sent to a peer. Once it's
+	// reached, new requests are refused unless they have a higher priority
+	// than one of the waiting ones, which is refused instead.
+	MaxQueue int
+	// PriorityAging is how long a waiting request takes to move up one
+	// priority, so lower priorities don't starve. 0 disables it.
+	PriorityAging time.Duration
+}
+
+// validate is a function that checks the congestion options are valid.
+func (o CongestionOptions) validate() error {
+	if o.MaxOutstanding < 0 {
+		return fmt.Errorf("Invalid max outstanding exchanges: %d", o.MaxOutstanding)
+	}
+
+	if o.BytesPerSecond < 0 {
+		return fmt.Errorf("Invalid rate limit: %d bytes per second", o.BytesPerSecond)
+	}
+
+	if o.MaxQueue < 0 {
+		return fmt.Errorf("Invalid max queue depth: %d", o.MaxQueue)
+	}
+
+	if o.PriorityAging < 0 {
+		return fmt.Errorf("Invalid priority aging: %v", o.PriorityAging)
+	}
+
+	return nil
+}
+
+// exchangeOutcome is the outcome of an exchange, as far as congestion control
+// is concerned.
+type exchangeOutcome int
+
+const (
+	// exchangeAnswered is an exchange which got answered without needing any
+	// retransmission.
+	exchangeAnswered exchangeOutcome = iota
+	// exchangeRetransmitted is an exchange which got answered after
+	// retransmissions.
+	exchangeRetransmitted
+	// exchangeFailed is an exchange which didn't get answered.
+	exchangeFailed
+)
+
+// link is a struct that limits the traffic sent to another proxy, following
+// its CongestionOptions.
+type link struct {
+	opts CongestionOptions
+
+	mut         sync.Mutex
+	outstanding int
+	window      float64
+	tokens      float64
+	refilled    time.Time
+	queue       []*linkWaiter
+	// wakeup is armed when the head of the queue is waiting for tokens.
+	wakeup   *time.Timer
+	rejected uint64
+}
+
+// linkWaiter is a struct that represents a request waiting to be sent on a
+// link.
+type linkWaiter struct {
+	size   int
+	prio   priority
+	queued time.Time
+	ready  chan struct{}
+	// granted is set when the request can be sent, and err when it has been
+	// evicted from the queue, before ready is closed.
+	granted bool
+	err     error
+}
+
+// linkSnapshot is a struct that holds the state of a link at a given time.
+type linkSnapshot struct {
+	outstanding int
+	window      float64
+	queued      int
+	rejected    uint64
+}
+
+// newLink is a function that returns a link with the given options, with a
+// full congestion window and a full token bucket.
+func newLink(opts CongestionOptions) *link {
+	return &link{
+		opts:     opts,
+		window:   float64(opts.MaxOutstanding),
+		tokens:   float64(opts.BytesPerSecond),
+		refilled: time.Now(),
+	}
+}
+
+// acquire is a function that waits until a request with a payload of the given
+// size and the given priority can be sent on the link, or the given context is
+// done. It returns errLinkCongested if the queue is full, or if the request
+// gets evicted from it by a higher priority one. release must be called once
+// the exchange is over if it returns nil.
+func (l *link) acquire(ctx context.Context, size int, prio priority) error {
+	l.mut.Lock()
+
+	l.refill()
+	if len(l.queue) == 0 && l.canSend() {
+		l.take(size)
+		l.mut.Unlock()
+		return nil
+	}
+
+	if len(l.queue) >= l.opts.MaxQueue && !l.evict(prio) {
+		l.rejected++
+		l.mut.Unlock()
+		return errLinkCongested
+	}
+
+	w := &linkWaiter{
+		size:   size,
+		prio:   prio,
+		queued: time.Now(),
+		ready:  make(chan struct{}),
+	}
+	l.queue = append(l.queue, w)
+	l.dispatch()
+	l.mut.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-ctx.Done():
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	switch {
+	case w.err != nil:
+		// It got evicted in the meantime, and is no longer in the queue.
+		return w.err
+	case w.granted:
+		// The request got its turn in the meantime, give it to the next one.
+		l.outstanding--
+		if l.opts.BytesPerSecond > 0 {
+			l.tokens += float64(w.size)
+		}
+		l.dispatch()
+	default:
+		for i := range l.queue {
+			if l.queue[i] == w {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// release is a function that signals that an exchange acquired on the link is
+// over, with the given outcome and response payload size, and lets the next
+// requests in the queue be sent if possible.
+func (l *link) release(outcome exchangeOutcome, resSize int) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.outstanding--
+	if l.opts.BytesPerSecond > 0 {
+		// The response took up the link too.
+		l.tokens -= float64(resSize)
+	}
+
+	if l.opts.MaxOutstanding > 0 {
+		if outcome == exchangeAnswered {
+			// Additive increase, by one every window's worth of exchanges.
+			l.window += 1 / l.window
+			if max := float64(l.opts.MaxOutstanding); l.window > max {
+				l.window = max
+			}
+		} else {
+			// Multiplicative decrease.
+			l.window /= 2
+			if l.window < 1 {
+				l.window = 1
+			}
+			common.Debugf("Halved the congestion window to %.2f", l.window)
+		}
+	}
+
+	l.dispatch()
+}
+
+// refill is a function that adds the tokens earned since the last refill to
+// the bucket. The link's lock must be held.
+func (l *link) refill() {
+	if l.opts.BytesPerSecond == 0 {
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.refilled).Seconds() * float64(l.opts.BytesPerSecond)
+	if max := float64(l.opts.BytesPerSecond); l.tokens > max {
+		l.tokens = max
+	}
+	l.refilled = now
+}
+
+// canSend is a function that returns whether the window and the rate limit
+// allow sending a request. The bucket can go into debt to send requests larger
+// than the burst, so it only needs not to be in debt. The link's lock must be
+// held.
+func (l *link) canSend() bool {
+	if l.opts.MaxOutstanding > 0 && l.outstanding >= int(l.window) {
+		return false
+	}
+
+	return l.opts.BytesPerSecond == 0 || l.tokens >= 0
+}
+
+// take is a function that accounts for a request with a payload of the given
+// size being sent. The link's lock must be held.
+func (l *link) take(size int) {
+	l.outstanding++
+	if l.opts.BytesPerSecond > 0 {
+		l.tokens -= float64(size)
+	}
+}
+
+// evict is a function that makes room in the full queue for a request with the
+// given priority, by refusing the most recent of the waiting requests with the
+// lowest priority if it's lower. It returns whether it made room. The link's
+// lock must be held.
+func (l *link) evict(prio priority) bool {
+	victim := -1
+	for i, w := range l.queue {
+		if w.prio > prio && (victim < 0 || w.prio >= l.queue[victim].prio) {
+			victim = i
+		}
+	}
+
+	if victim < 0 {
+		return false
+	}
+
+	w := l.queue[victim]
+	l.queue = append(l.queue[:victim], l.queue[victim+1:]...)
+	l.rejected++
+	w.err = errLinkCongested
+	close(w.ready)
+
+	common.Debugf("Evicted a %s priority request from the queue", w.prio)
+
+	return true
+}
+
+// next is a function that returns the index in the queue of the request to
+// send next, i.e. the first one with the highest priority once aged. The queue
+// mustn't be empty. The link's lock must be held.
+func (l *link) next() int {
+	now := time.Now()
+
+	next := 0
+	best := l.queue[0].rank(now, l.opts.PriorityAging)
+	for i, w := range l.queue[1:] {
+		if rank := w.rank(now, l.opts.PriorityAging); rank < best {
+			next, best = i+1, rank
+		}
+	}
+
+	return next
+}
+
+// dispatch is a function that lets the requests in the queue be sent, highest
+// priority first, for as long as the window and the rate limit allow it, and
+// arms a timer to try again once the bucket is out of debt if that's what the
+// queue is waiting for. The link's lock must be held.
+func (l *link) dispatch() {
+	l.refill()
+
+	for len(l.queue) > 0 && l.canSend() {
+		i := l.next()
+		w := l.queue[i]
+		l.queue = append(l.queue[:i], l.queue[i+1:]...)
+		l.take(w.size)
+		w.granted = true
+		close(w.ready)
+	}
+
+	if len(l.queue) == 0 || l.tokens >= 0 || l.wakeup != nil {
+		return
+	}
+
+	wait := time.Duration(-l.tokens / float64(l.opts.BytesPerSecond) * float64(time.Second))
+	l.wakeup = time.AfterFunc(wait, func() {
+		l.mut.Lock()
+		defer l.mut.Unlock()
+
+		l.wakeup = nil
+		l.dispatch()
+	})
+}
+
+// snapshot is a function that returns the current state of the link.
+func (l *link) snapshot() linkSnapshot {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return linkSnapshot{
+		outstanding: l.outstanding,
+		window:      l.window,
+		queued:      len(l.queue),
+		rejected:    l.rejected,
+	}
+}
+
+// linkSet is a struct that holds the link to each peer, by the address
+// requests are sent to.
+type linkSet struct {
+	mut   sync.Mutex
+	links map[string]*link
+}
+
+// newLinkSet is a function that returns an empty linkSet.
+func newLinkSet() *linkSet {
+	return &linkSet{links: make(map[string]*link)}
+}
+
+// get is a function that returns the link to the given target, creating it
+// with the given options if it doesn't exist.
+func (s *linkSet) get(target string, opts CongestionOptions) *link {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	l, ok := s.links[target]
+	if !ok {
+		l = newLink(opts)
+		s.links[target] = l
+	}
+
+	return l
+}
+
+// lookup is a function that returns the link to the given target, which must
+// exist.
+func (s *linkSet) lookup(target string) *link {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.links[target]
+}
+
+// targets is a function that returns the targets which have a link, in
+// alphabetical order.
+func (s *linkSet) targets() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	targets := make([]string, 0, len(s.links))
+	for target := range s.links {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
@@ -0,0 +1,488 @@
+package proxy
+
+import (
+	"context"
+	encjson "encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// storedRequestExt is the extension of the files requests are stored in.
+const storedRequestExt = ".json"
+
+// errQueueFull is the error returned when a request can't be queued because
+// too many are already queued for the same proxy.
+var errQueueFull = errors.New("Too many requests are queued for the remote proxy")
+
+// StoreForwardOptions is a struct that holds how to queue the requests on some
+// routes when the proxy they're for can't be reached, until it can be.
+type StoreForwardOptions struct {
+	// Dir is the directory to store queued requests in, so they survive
+	// restarts. Requests are never queued if it's empty.
+	Dir string
+	// Routes are the routes which requests can be queued, as the method and
+	// path of their entry in routes.json, e.g.
+	// "PUT /_matrix/federation/v1/send/{txnId}". The homeserver mustn't need
+	// anything from their responses, as they're answered before being sent.
+	// Requests on client routes can't be queued, as their access token isn't
+	// stored.
+	Routes []string
+	// Status is the HTTP status code to answer queued requests with, which
+	// tells the homeserver they've been accepted but not processed yet.
+	Status int
+	// RetryInterval is how long to wait before trying to send the requests
+	// queued for a proxy again, unless a connection to it gets opened in the
+	// meantime.
+	RetryInterval time.Duration
+	// MaxQueue is how many requests can be queued for a proxy, 0 for no
+	// limit. Requests which can't be queued fail as if none could.
+	MaxQueue int
+}
+
+// validate is a function that checks the store-and-forward options are valid.
+func (o StoreForwardOptions) validate() error {
+	for _, r := range o.Routes {
+		fields := strings.Fields(r)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+			return fmt.Errorf("Invalid store-and-forward route %q, expected a method and a path", r)
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "POST", "PUT", "DELETE":
+		default:
+			return fmt.Errorf("Invalid store-and-forward route %q, only writes can be queued", r)
+		}
+
+		if isClientRoute(fields[1]) {
+			return fmt.Errorf("Invalid store-and-forward route %q, requests on client routes can't be queued", r)
+		}
+	}
+
+	if o.Status < 202 || o.Status > 299 {
+		return fmt.Errorf("Invalid store-and-forward status %d, expected a success which isn't 200 or 201", o.Status)
+	}
+
+	if o.RetryInterval <= 0 {
+		return fmt.Errorf("Invalid store-and-forward retry interval: %v", o.RetryInterval)
+	}
+
+	if o.MaxQueue < 0 {
+		return fmt.Errorf("Invalid store-and-forward max queue: %d", o.MaxQueue)
+	}
+
+	return nil
+}
+
+// unreachableError is an error which occurred because another proxy couldn't
+// be reached, i.e. no connection to it could be opened or an exchange with it
+// got no answer even on a new connection.
+type unreachableError struct {
+	err error
+}
+
+// Error implements error.
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+// proxiedRequest is a struct that holds an HTTP request to proxy to another
+// proxy, which is also how it's stored when it's queued. Its Authorization
+// header isn't stored, only the server it comes from over federation, which is
+// all the other proxy gets from it.
+type proxiedRequest struct {
+	Target        string `json:"target"`
+	Method        string `json:"method"`
+	URI           string `json:"uri"`
+	Authorization string `json:"-"`
+	Origin        string `json:"origin,omitempty"`
+	Body          []byte `json:"body,omitempty"`
+
+	// seq orders the queued requests, and names the file they're stored in.
+	seq uint64
+}
+
+// key is a function that returns what identifies the request among the ones
+// queued, so it's only queued once even if the homeserver sends it again.
+// Requests which can be queued are idempotent, so their path holds a
+// transaction ID.
+func (req *proxiedRequest) key() string {
+	return strings.ToUpper(req.Method) + " " + req.URI
+}
+
+// credentials is a function that returns the access token of the request if
+// it's on a client route, or the server it comes from if it's a federation one.
+// The server of a queued request is the one it was stored with, as its
+// Authorization header is gone.
+func (req *proxiedRequest) credentials(path string) (accessToken string, origin *string) {
+	if authHeader := req.Authorization; len(authHeader) > 0 {
+		if isClientRoute(path) {
+			accessToken = strings.Replace(authHeader, "Bearer ", "", 1)
+		} else if submatch := fedAuthRgxp.FindStringSubmatch(authHeader); submatch != nil {
+			origin = &submatch[1]
+		}
+	} else if len(req.Origin) > 0 {
+		origin = &req.Origin
+	}
+
+	return
+}
+
+// stripCredentials is a function that replaces the request's Authorization
+// header with the server it comes from, so the header isn't written to disk.
+func (req *proxiedRequest) stripCredentials() {
+	if u, err := url.ParseRequestURI(req.URI); err == nil {
+		if _, origin := req.credentials(u.Path); origin != nil {
+			req.Origin = *origin
+		}
+	}
+
+	req.Authorization = ""
+}
+
+// forwardQueue is a struct that holds the requests queued for a proxy, from
+// the oldest.
+type forwardQueue struct {
+	target  string
+	pending []*proxiedRequest
+	keys    map[string]bool
+	// running is whether requests are being sent from the queue.
+	running bool
+	// kick wakes the queue up when it's waiting to retry.
+	kick chan struct{}
+}
+
+// storeForward is a struct that queues the requests which couldn't be sent to
+// other proxies on disk, and sends them in order once they can be.
+type storeForward struct {
+	p      *Proxy
+	opts   StoreForwardOptions
+	routes map[string]bool
+
+	mut     sync.Mutex
+	lastSeq uint64
+	queues  map[string]*forwardQueue
+	stopped bool
+	stop    chan struct{}
+}
+
+// newStoreForward is a function that returns a storeForward following the given
+// options, with the requests stored in its directory queued again. It returns
+// nil if store-and-forward is disabled.
+func newStoreForward(p *Proxy, opts StoreForwardOptions) (*storeForward, error) {
+	if len(opts.Dir) == 0 {
+		return nil, nil
+	}
+
+	sf := &storeForward{
+		p:      p,
+		opts:   opts,
+		routes: make(map[string]bool),
+		queues: make(map[string]*forwardQueue),
+		stop:   make(chan struct{}),
+	}
+
+	for _, r := range opts.Routes {
+		fields := strings.Fields(r)
+		sf.routes[strings.ToUpper(fields[0])+" "+fields[1]] = true
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := sf.load(); err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Dir, err)
+	}
+
+	return sf, nil
+}
+
+// load is a function that queues the requests stored in the directory again.
+func (sf *storeForward) load() error {
+	files, err := ioutil.ReadDir(sf.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var reqs []*proxiedRequest
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, storedRequestExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, storedRequestExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(sf.opts.Dir, name))
+		if err != nil {
+			return err
+		}
+
+		req := &proxiedRequest{seq: seq}
+		if err = encjson.Unmarshal(b, req); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].seq < reqs[j].seq })
+
+	for _, req := range reqs {
+		q := sf.queue(req.Target)
+		q.pending = append(q.pending, req)
+		q.keys[req.key()] = true
+		sf.lastSeq = req.seq
+	}
+
+	if len(reqs) > 0 {
+		log.Printf("Loaded %d queued requests from %s", len(reqs), sf.opts.Dir)
+	}
+
+	return nil
+}
+
+// queue is a function that returns the queue of the given proxy, creating it
+// if needed. It must be called with the lock held.
+func (sf *storeForward) queue(target string) *forwardQueue {
+	q, ok := sf.queues[target]
+	if !ok {
+		q = &forwardQueue{
+			target: target,
+			keys:   make(map[string]bool),
+			kick:   make(chan struct{}, 1),
+		}
+		sf.queues[target] = q
+	}
+
+	return q
+}
+
+// resume is a function that starts sending the requests loaded from the
+// directory.
+func (sf *storeForward) resume() {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+
+	for _, q := range sf.queues {
+		if len(q.pending) > 0 && !q.running {
+			q.running = true
+			go sf.run(q, false)
+		}
+	}
+}
+
+// eligible is a function that returns whether the given request can be
+// queued, i.e. whether it's on one of the routes in the options according to
+// the newest maps.
+func (sf *storeForward) eligible(req *proxiedRequest) bool {
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return false
+	}
+
+	ms := sf.p.loadedMaps().newest()
+	match, found := ms.identifyRoute(u.Path, req.Method)
+	if !found {
+		return false
+	}
+
+	r := ms.routes[match.id]
+	return sf.routes[strings.ToUpper(r.Method)+" "+r.Path]
+}
+
+// queued is a function that returns whether requests are queued for the given
+// proxy, in which case new ones need to be queued behind them to be sent in
+// order.
+func (sf *storeForward) queued(target string) bool {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+
+	q, ok := sf.queues[target]
+	return ok && len(q.pending) > 0
+}
+
+// enqueue is a function that stores the given request and queues it to be sent
+// once its proxy can be reached. It returns false if the queue is full. A
+// request which is already queued isn't queued again.
+func (sf *storeForward) enqueue(req *proxiedRequest) (bool, error) {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+
+	q := sf.queue(req.Target)
+	if q.keys[req.key()] {
+		common.Debugf("%s %s is already queued", req.Method, req.URI)
+		return true, nil
+	}
+
+	if sf.opts.MaxQueue > 0 && len(q.pending) >= sf.opts.MaxQueue {
+		return false, nil
+	}
+
+	req.stripCredentials()
+
+	sf.lastSeq++
+	req.seq = sf.lastSeq
+
+	if err := sf.write(req); err != nil {
+		return false, err
+	}
+
+	q.pending = append(q.pending, req)
+	q.keys[req.key()] = true
+
+	log.Printf("Queued %s %s for %s (%d queued)", req.Method, req.URI, req.Target, len(q.pending))
+
+	if !q.running && !sf.stopped {
+		q.running = true
+		go sf.run(q, true)
+	}
+
+	return true, nil
+}
+
+// write is a function that stores the given request in the directory. The
+// file is only given its name once it's been fully written, so a crash can't
+// leave a truncated request to be loaded.
+func (sf *storeForward) write(req *proxiedRequest) error {
+	b, err := encjson.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	path := sf.path(req)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// path is a function that returns the path of the file the given request is
+// stored in.
+func (sf *storeForward) path(req *proxiedRequest) string {
+	return filepath.Join(sf.opts.Dir, fmt.Sprintf("%020d%s", req.seq, storedRequestExt))
+}
+
+// kickTarget is a function that makes the queue of the given proxy try to send
+// its requests straight away if it's waiting to retry, e.g. because a
+// connection to the proxy just got opened.
+func (sf *storeForward) kickTarget(target string) {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+
+	if q, ok := sf.queues[target]; ok {
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run is a function that sends the requests of the given queue in order, until
+// it's empty. If wait is true, it waits before trying to send the first one,
+// as its proxy has just been found unreachable.
+func (sf *storeForward) run(q *forwardQueue, wait bool) {
+	for {
+		if wait {
+			select {
+			case <-time.After(sf.opts.RetryInterval):
+			case <-q.kick:
+			case <-sf.stop:
+				return
+			}
+		}
+
+		sf.mut.Lock()
+		if sf.stopped || len(q.pending) == 0 {
+			q.running = false
+			sf.mut.Unlock()
+			return
+		}
+		req := q.pending[0]
+		sf.mut.Unlock()
+
+		wait = !sf.send(req)
+		if wait {
+			continue
+		}
+
+		sf.mut.Lock()
+		q.pending = q.pending[1:]
+		delete(q.keys, req.key())
+		left := len(q.pending)
+		sf.mut.Unlock()
+
+		if err := os.Remove(sf.path(req)); err != nil {
+			log.Printf("ERROR: Failed to remove queued request %s: %v", sf.path(req), err)
+		}
+
+		common.Debugf("%d requests left in the queue of %s", left, q.target)
+	}
+}
+
+// send is a function that sends the given queued request, and returns whether
+// it's done with, i.e. whether it's been answered or can't ever be sent. It
+// returns false if it needs to be tried again later.
+func (sf *storeForward) send(req *proxiedRequest) bool {
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), "store_forward")
+	defer span.Finish()
+
+	_, statusCode, err := sf.p.proxyRequest(ctx, span, req)
+	if _, ok := err.(*unreachableError); ok || err == errLinkCongested || err == errMapsMismatch {
+		common.Debugf("Failed to send queued request %s %s to %s: %v", req.Method, req.URI, req.Target, err)
+		return false
+	} else if err != nil {
+		log.Printf("ERROR: Dropping queued request %s %s to %s: %v", req.Method, req.URI, req.Target, err)
+		return true
+	}
+
+	if httpCode := statusCoAPToHTTP(statusCode); httpCode >= 400 {
+		log.Printf("WARNING: Queued request %s %s to %s got a %d", req.Method, req.URI, req.Target, httpCode)
+	} else {
+		log.Printf("Sent queued request %s %s to %s", req.Method, req.URI, req.Target)
+	}
+
+	return true
+}
+
+// close is a function that stops sending queued requests. The ones which
+// haven't been sent yet stay stored, and are sent once the proxy starts again.
+func (sf *storeForward) close() {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+
+	if !sf.stopped {
+		sf.stopped = true
+		close(sf.stop)
+	}
+}
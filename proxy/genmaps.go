@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"bufio"
+	encjson "encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/matrix-org/coap-proxy/types"
+
+	"github.com/klauspost/compress/dict"
+)
+
+const (
+	// Maximum length of a string value from the corpus to consider adding to
+	// the flate dictionary.
+	maxDictValueLen = 64
+	// Maximum size of a line of the corpus.
+	maxCorpusLineLen = 16 * 1024 * 1024
+)
+
+// capturedExchange is a struct that represents a line of a captured traffic
+// corpus, i.e. an HTTP request and its response.
+type capturedExchange struct {
+	Method       string             `json:"method"`
+	Path         string             `json:"path"`
+	RequestBody  encjson.RawMessage `json:"request_body,omitempty"`
+	ResponseBody encjson.RawMessage `json:"response_body,omitempty"`
+}
+
+// GenMaps is a function that implements the gen-maps subcommand, which learns
+// a new set of maps from a corpus of captured traffic and compares it with the
+// maps in the directory given in the options, given the subcommand's
+// arguments. It doesn't need a proxy to be set up. It returns the process's
+// exit code.
+func GenMaps(opts Options, args []string) int {
+	fs := flag.NewFlagSet("gen-maps", flag.ExitOnError)
+	corpusPath := fs.String("corpus", "", "JSON-lines file of captured HTTP requests and responses, one per line with the keys \"method\", \"path\", \"request_body\" and \"response_body\"")
+	outDir := fs.String("out", "", "Directory to write the generated maps to")
+	dictSize := fs.Int("dict-size", 8192, "Maximum size in bytes of the generated extra_flate_data")
+	zstdDictSize := fs.Int("zstd-dict-size", 16384, "Maximum size in bytes of the generated zstd_dict, or 0 to not generate one")
+	serverNames := fs.String("server-names", "", "Comma-separated list of the federation server names of the deployment, to list in server_names.json even if the corpus doesn't have them")
+	_ = fs.Parse(args)
+
+	if len(*corpusPath) == 0 || len(*outDir) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	corpus, err := readCorpus(*corpusPath)
+	if err != nil {
+		log.Printf("ERROR: Failed to read corpus: %v", err)
+		return 1
+	}
+
+	log.Printf("Read %d exchanges from %s", len(corpus), *corpusPath)
+
+	current, err := loadMaps(opts.MapsDir, opts.Compression)
+	if err != nil {
+		log.Printf("ERROR: Failed to load the current maps: %v", err)
+		return 1
+	}
+
+	var extraNames []string
+	for _, name := range strings.Split(*serverNames, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			extraNames = append(extraNames, name)
+		}
+	}
+
+	if err = writeGeneratedMaps(current, corpus, extraNames, *outDir, *dictSize); err != nil {
+		log.Printf("ERROR: Failed to generate maps: %v", err)
+		return 1
+	}
+
+	if *zstdDictSize > 0 {
+		if err = writeZstdDict(corpus, *outDir, *zstdDictSize); err != nil {
+			log.Printf("ERROR: Failed to train zstd dictionary: %v", err)
+			return 1
+		}
+	}
+
+	generated, err := loadMaps(*outDir, opts.Compression)
+	if err != nil {
+		log.Printf("ERROR: Generated maps are invalid: %v", err)
+		return 1
+	}
+
+	log.Printf("Wrote maps version %s to %s", generated.version, *outDir)
+
+	before, unknown := estimateWireSize(current, current.compressor, corpus)
+	after, _ := estimateWireSize(generated, generated.compressor, corpus)
+
+	log.Printf("%d exchanges are on routes missing from routes.json", unknown)
+	log.Printf("Estimated bytes on the wire with the current maps: %d", before)
+	log.Printf("Estimated bytes on the wire with the generated maps: %d", after)
+	if before > 0 {
+		log.Printf(
+			"Estimated saving: %d bytes (%.1f%%)",
+			before-after, 100*float64(before-after)/float64(before),
+		)
+	}
+
+	// Compare the compression backends with the generated maps, so we can
+	// tell whether switching is worth it.
+	for _, backend := range []string{types.BackendFlate, types.BackendZstd} {
+		comp, err := types.NewCompressor(*outDir, dictFiles, generated.version, backend, cbor)
+		if err != nil {
+			log.Printf("ERROR: Failed to set up %s with the generated maps: %v", backend, err)
+			return 1
+		}
+
+		size, _ := estimateWireSize(generated, comp, corpus)
+		log.Printf("Estimated bytes on the wire with the generated maps and %s: %d", backend, size)
+	}
+
+	return 0
+}
+
+// readCorpus is a function that reads a corpus of captured traffic.
+func readCorpus(path string) ([]capturedExchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var corpus []capturedExchange
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxCorpusLineLen)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var ex capturedExchange
+		if err = encjson.Unmarshal([]byte(line), &ex); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		if len(ex.Method) == 0 || len(ex.Path) == 0 {
+			return nil, fmt.Errorf("line %d: missing method or path", n)
+		}
+
+		corpus = append(corpus, ex)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(corpus) == 0 {
+		return nil, errors.New("corpus is empty")
+	}
+
+	return corpus, nil
+}
+
+// writeGeneratedMaps is a function that learns maps from the given corpus and
+// writes them to the given directory, with the given server names listed along
+// with the ones seen in the corpus. Maps which aren't learned are copied from
+// the given current maps' directory.
+func writeGeneratedMaps(
+	current *mapSet, corpus []capturedExchange, serverNames []string, outDir string, dictSize int,
+) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	// Copy the maps we don't learn from the current ones.
+	for _, f := range []string{"event_types.json", "error_codes.json", "edu_types.json", "common_values.json"} {
+		b, err := ioutil.ReadFile(filepath.Join(current.dir, f))
+		if err != nil {
+			return err
+		}
+
+		if err = ioutil.WriteFile(filepath.Join(outDir, f), b, 0644); err != nil {
+			return err
+		}
+	}
+
+	keys, dict := learnDictionary(corpus, dictSize)
+
+	if err := writeJSONMap(filepath.Join(outDir, "routes.json"), rankRoutes(current, corpus)); err != nil {
+		return err
+	}
+
+	if err := writeJSONMap(filepath.Join(outDir, "query_params.json"), rankQueryParams(current, corpus)); err != nil {
+		return err
+	}
+
+	if err := writeJSONMap(filepath.Join(outDir, "common_keys.json"), keys); err != nil {
+		return err
+	}
+
+	if err := writeJSONMap(filepath.Join(outDir, types.ServerNamesFile), rankServerNames(current, corpus, serverNames)); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(outDir, "extra_flate_data"), []byte(dict), 0644)
+}
+
+// writeZstdDict is a function that trains a zstd dictionary on the CBOR
+// encodings of the bodies of the corpus, and writes it to the given directory.
+func writeZstdDict(corpus []capturedExchange, outDir string, dictSize int) error {
+	var samples [][]byte
+	for _, ex := range corpus {
+		for _, raw := range []encjson.RawMessage{ex.RequestBody, ex.ResponseBody} {
+			if len(raw) > 0 {
+				samples = append(samples, cbor.Encode(json.Decode(raw)))
+			}
+		}
+	}
+
+	d, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictSize,
+		HashBytes:   6,
+		// IDs lower than 256 only take a byte in the frames' headers.
+		ZstdDictID: 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(outDir, types.ZstdDictFile), d, 0644)
+}
+
+// writeJSONMap is a function that writes a map file with the same formatting
+// as the ones we ship.
+func writeJSONMap(path string, val interface{}) error {
+	b, err := encjson.MarshalIndent(val, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// rankRoutes is a function that orders the current routes from the most to
+// the least used in the corpus, so the most used ones get the shortest IDs.
+// Routes used as often keep their current order.
+func rankRoutes(current *mapSet, corpus []capturedExchange) []route {
+	hits := make([]int, len(current.routes))
+	for _, ex := range corpus {
+		u, err := url.Parse(ex.Path)
+		if err != nil {
+			continue
+		}
+
+		if m, found := current.identifyRoute(u.Path, ex.Method); found {
+			hits[m.id]++
+		}
+	}
+
+	ids := make([]int, len(current.routes))
+	for i := range ids {
+		ids[i] = i
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		return hits[ids[i]] > hits[ids[j]]
+	})
+
+	routes := make([]route, 0, len(ids))
+	for _, id := range ids {
+		routes = append(routes, current.routes[id])
+	}
+
+	return routes
+}
+
+// rankQueryParams is a function that orders the query parameters seen in the
+// corpus, followed by the current ones which weren't seen, from the most to
+// the least used, so the most used ones get the shortest indices.
+func rankQueryParams(current *mapSet, corpus []capturedExchange) []string {
+	hits := make(map[string]int)
+	var params []string
+
+	for _, ex := range corpus {
+		u, err := url.Parse(ex.Path)
+		if err != nil {
+			continue
+		}
+
+		for key := range u.Query() {
+			if _, seen := hits[key]; !seen {
+				params = append(params, key)
+			}
+			hits[key]++
+		}
+	}
+
+	// Sort the keys seen in the corpus alphabetically first so the output
+	// doesn't depend on map iteration order.
+	sort.Strings(params)
+
+	for _, key := range current.queryParams {
+		if _, seen := hits[key]; !seen {
+			params = append(params, key)
+			hits[key] = 0
+		}
+	}
+
+	sort.SliceStable(params, func(i, j int) bool {
+		return hits[params[i]] > hits[params[j]]
+	})
+
+	return params
+}
+
+// rankServerNames is a function that orders the server names seen in the
+// destination tables of the transactions in the corpus, followed by the given
+// ones and the current ones which weren't seen, from the most to the least
+// used, so the most used ones get the lowest indices and therefore the shortest
+// bit fields.
+func rankServerNames(current *mapSet, corpus []capturedExchange, extra []string) []string {
+	hits := make(map[string]int)
+	var names []string
+
+	for _, ex := range corpus {
+		u, err := url.Parse(ex.Path)
+		if err != nil || len(ex.RequestBody) == 0 {
+			continue
+		}
+
+		m, found := current.identifyRoute(u.Path, ex.Method)
+		if !found || current.routes[m.id].Name != "send_transaction" {
+			continue
+		}
+
+		body, _ := json.Decode(ex.RequestBody).(map[interface{}]interface{})
+		pdus, _ := body["pdus"].([]interface{})
+		for _, pdu := range pdus {
+			pduMap, _ := pdu.(map[interface{}]interface{})
+			unsigned, _ := pduMap["unsigned"].(map[interface{}]interface{})
+			dtab, _ := unsigned["dtab"].([]interface{})
+			for _, entry := range dtab {
+				entrySlice, _ := entry.([]interface{})
+				if len(entrySlice) != 2 {
+					continue
+				}
+
+				servers, _ := entrySlice[1].([]interface{})
+				for _, s := range servers {
+					name, ok := s.(string)
+					if !ok {
+						continue
+					}
+
+					if _, seen := hits[name]; !seen {
+						names = append(names, name)
+					}
+					hits[name]++
+				}
+			}
+		}
+	}
+
+	// Sort the names seen in the corpus alphabetically first so the output
+	// doesn't depend on map iteration order.
+	sort.Strings(names)
+
+	for _, name := range append(extra, current.compressor.ServerNames()...) {
+		if _, seen := hits[name]; !seen {
+			names = append(names, name)
+			hits[name] = 0
+		}
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		return hits[names[i]] > hits[names[j]]
+	})
+
+	if names == nil {
+		names = make([]string, 0)
+	}
+
+	return names
+}
+
+// learnDictionary is a function that looks for the strings appearing the most
+// in the CBOR encoding of the bodies of the corpus. It returns the keys of the
+// bodies' objects from the most to the least used, and the content of an
+// extra_flate_data file with the strings worth the most bytes, the most
+// valuable last so they end up closest to the data being compressed.
+func learnDictionary(corpus []capturedExchange, dictSize int) (keys []string, dict string) {
+	keys = make([]string, 0)
+	keyHits := make(map[string]int)
+	tokenHits := make(map[string]int)
+
+	for _, ex := range corpus {
+		for _, raw := range []encjson.RawMessage{ex.RequestBody, ex.ResponseBody} {
+			if len(raw) == 0 {
+				continue
+			}
+
+			collectTokens(json.Decode(raw), keyHits, tokenHits)
+		}
+	}
+
+	for key := range keyHits {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keyHits[keys[i]] != keyHits[keys[j]] {
+			return keyHits[keys[i]] > keyHits[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	// A token saves roughly its length minus the size of a back-reference
+	// every time it appears after the first one.
+	score := func(token string) int {
+		return (tokenHits[token] - 1) * (len(token) - 3)
+	}
+
+	var tokens []string
+	for token := range tokenHits {
+		if len(token) > 3 && tokenHits[token] > 1 {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if score(tokens[i]) != score(tokens[j]) {
+			return score(tokens[i]) > score(tokens[j])
+		}
+		return tokens[i] < tokens[j]
+	})
+
+	var selected []string
+	size := 0
+	for _, token := range tokens {
+		if size+len(token) > dictSize {
+			continue
+		}
+
+		// Skip tokens which are already covered by a more valuable one.
+		covered := false
+		for _, s := range selected {
+			if strings.Contains(s, token) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		selected = append(selected, token)
+		size += len(token)
+	}
+
+	lines := make([]string, 0, len(selected))
+	for i := len(selected) - 1; i >= 0; i-- {
+		lines = append(lines, dictLine(selected[i]))
+	}
+
+	return keys, strings.Join(lines, "\n") + "\n"
+}
+
+// collectTokens is a function that counts the object keys in a decoded body,
+// along with the CBOR encodings of the keys, short string values and key/value
+// pairs it contains.
+func collectTokens(val interface{}, keyHits map[string]int, tokenHits map[string]int) {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		for k, el := range v {
+			key, ok := k.(string)
+			if !ok {
+				continue
+			}
+
+			keyHits[key]++
+
+			encodedKey := string(cbor.Encode(key))
+			tokenHits[encodedKey]++
+
+			if s, ok := el.(string); ok && len(s) <= maxDictValueLen {
+				tokenHits[encodedKey+string(cbor.Encode(s))]++
+			}
+
+			collectTokens(el, keyHits, tokenHits)
+		}
+	case []interface{}:
+		for _, el := range v {
+			collectTokens(el, keyHits, tokenHits)
+		}
+	case string:
+		if len(v) <= maxDictValueLen {
+			tokenHits[string(cbor.Encode(v))]++
+		}
+	}
+}
+
+// dictLine is a function that formats a string for extra_flate_data, quoting
+// it if it wouldn't be read back as is otherwise.
+func dictLine(token string) string {
+	if len(token) == 0 || !utf8.ValidString(token) || strings.TrimSpace(token) != token ||
+		strings.ContainsAny(token[:1], "\"'`") {
+		return strconv.Quote(token)
+	}
+
+	for _, r := range token {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(token)
+		}
+	}
+
+	return token
+}
+
+// estimateWireSize is a function that estimates how many bytes the paths and
+// payloads of the exchanges in the corpus would take on the wire if compressed
+// with the given maps and compressor. It also returns how many exchanges were
+// on unknown routes.
+func estimateWireSize(
+	ms *mapSet, comp *types.Compressor, corpus []capturedExchange,
+) (size int, unknown int) {
+	for _, ex := range corpus {
+		u, err := url.Parse(ex.Path)
+		if err != nil {
+			continue
+		}
+
+		m, found := ms.identifyRoute(u.Path, ex.Method)
+		if !found {
+			unknown++
+		}
+
+		size += len(ms.genCompressedPath(u, m))
+
+		for i, raw := range []encjson.RawMessage{ex.RequestBody, ex.ResponseBody} {
+			if len(raw) == 0 {
+				continue
+			}
+
+			body := json.Decode(raw)
+			if i == 0 && found && ms.routes[m.id].Name == "send_transaction" {
+				body = comp.CompressTransaction(body)
+			}
+			body = comp.CompressBody(body)
+
+			pl, err := comp.CompressPayload(cbor.Encode(body))
+			if err != nil {
+				continue
+			}
+
+			size += len(pl)
+		}
+	}
+
+	return
+}
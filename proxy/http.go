@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/matrix-org/go-coap"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	olog "github.com/opentracing/opentracing-go/log"
+)
+
+// Client for outbound HTTP requests to homeservers
+var httpClient = &http.Client{}
+
+// serveHTTP is a function which handles HTTP requests.
+// It:
+//   * Takes in an HTTP request
+//   * Compresses the path, query parameters and body if possible
+//   * Creates a CoAP request with carried over and compressed headers, path, body etc.
+//   * Sends the CoAP request to another proxy, retrieves the response
+//   * Decompresses the response back into normal HTTP
+//   * Returns it to the original sender
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		common.Debug("Got preflight request")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "content-type,authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST,GET,PUT,DELETE,OPTIONS")
+		return
+	}
+
+	common.Debugf("HTTP: Got request on path %s", r.URL.Path)
+
+	// Set up an OpenTracing span to track this request's lifecycle
+	var serverSpan opentracing.Span
+	wireContext, err := opentracing.GlobalTracer().Extract(
+		opentracing.HTTPHeaders,
+		opentracing.HTTPHeadersCarrier(r.Header))
+
+	serverSpan = opentracing.StartSpan(
+		"http_server",
+		ext.RPCServerOption(wireContext))
+
+	defer serverSpan.Finish()
+
+	ctx := opentracing.ContextWithSpan(r.Context(), serverSpan)
+
+	ext.HTTPMethod.Set(serverSpan, r.Method)
+	ext.HTTPUrl.Set(serverSpan, r.URL.Path)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(err, serverSpan)
+		return
+	}
+
+	if len(body) > 0 {
+		contentType := r.Header.Get("content-type")
+		common.Debugf("Got request with content type: %s", contentType)
+
+		if contentType != "application/json" {
+			common.Debug("Got non-json request, ignoring")
+
+			w.WriteHeader(502)
+			return
+		}
+	}
+
+	req := &proxiedRequest{
+		Target:        p.coapTargetFor(r.Host),
+		Method:        r.Method,
+		URI:           r.URL.RequestURI(),
+		Authorization: r.Header.Get("Authorization"),
+		Body:          body,
+	}
+
+	// Requests which can be queued go behind the ones already queued for the
+	// same proxy, so they're sent in order
+	queueable := p.forwarding != nil && p.forwarding.eligible(req)
+	if queueable && p.forwarding.queued(req.Target) {
+		p.storeAndForward(w, req, serverSpan, nil)
+		return
+	}
+
+	resBody, statusCode, err := p.proxyRequest(ctx, serverSpan, req)
+	if _, ok := err.(*unreachableError); ok && queueable {
+		p.storeAndForward(w, req, serverSpan, err)
+		return
+	} else if err == errLinkCongested {
+		handleErr(err, serverSpan)
+		writeMatrixError(w, http.StatusServiceUnavailable, "M_UNKNOWN", err.Error())
+		return
+	} else if err != nil {
+		handleErr(err, serverSpan)
+		writeMatrixError(w, http.StatusBadGateway, "M_UNKNOWN", err.Error())
+		return
+	}
+
+	ext.HTTPStatusCode.Set(serverSpan, statusCoAPToHTTP(statusCode))
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "content-type,authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "POST,GET,PUT,DELETE,OPTIONS")
+
+	// CoAP requests use CBOR as their encoding scheme. Decode CBOR and encode back
+	// into JSON (if this response has a body)
+	if resBody != nil {
+		// The remote proxy may have dropped the error's message to save
+		// bandwidth
+		if statusCoAPToHTTP(statusCode) >= 400 {
+			restoreErrorMessage(resBody)
+		}
+
+		pl := json.Encode(resBody)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(statusCoAPToHTTP(statusCode)))
+		if _, err = w.Write(pl); err != nil {
+			log.Printf("Failed to write HTTP response: %s", err.Error())
+		}
+	} else {
+		w.WriteHeader(int(statusCoAPToHTTP(statusCode)))
+	}
+
+	common.Debugf("CoAP server responded with code %s", statusCode.String())
+	common.Debug("HTTP: Sending response")
+}
+
+// proxyRequest is a function that sends the given HTTP request to another
+// proxy over CoAP, and returns the decoded body and the code of the response.
+// The body of the response is nil if it doesn't have a payload.
+func (p *Proxy) proxyRequest(
+	ctx context.Context, serverSpan opentracing.Span, req *proxiedRequest,
+) (resBody interface{}, statusCode coap.COAPCode, err error) {
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return
+	}
+
+	// Get a connection to the remote proxy, which also tells us whether we can
+	// use our maps to talk to it
+	c, err := p.conns.get(req.Target)
+	if err != nil {
+		return nil, 0, &unreachableError{err}
+	}
+	defer c.release()
+
+	if c.compat == mapsRefused {
+		return nil, 0, errMapsMismatch
+	}
+
+	// Convert the path and HTTP method into an identifier represented by a single
+	// integer (for compression purposes)
+	ms := c.maps
+	match, foundRoute := ms.identifyRoute(u.Path, req.Method)
+
+	var method, routeName string
+	prio := priorityNormal
+	if foundRoute {
+		common.Debugf(
+			"HTTP: Got request on route #%d (%s %s)\n",
+			match.id, strings.ToUpper(ms.routes[match.id].Method),
+			ms.routes[match.id].Path,
+		)
+
+		method = strings.ToUpper(ms.routes[match.id].Method)
+		routeName = ms.routes[match.id].Name
+		prio = ms.routes[match.id].priority()
+	} else {
+		common.Debugf(
+			"HTTP: Got request on unknown route %s %s\n",
+			req.Method,
+			u.Path,
+		)
+
+		method = req.Method
+	}
+
+	serverSpan.SetTag("route.name", routeName)
+	serverSpan.SetTag("route.priority", prio.String())
+	common.Debug("routeName", routeName)
+
+	// Unmarshal request body JSON
+	var decodedBody interface{}
+	if len(req.Body) > 0 {
+		decodedBody = json.Decode(req.Body)
+	}
+
+	// Add authentication header to query parameters of CoAP request
+	accessToken, origin := req.credentials(u.Path)
+
+	// Answer syncs from the remote proxy's notifications if we're observing
+	// them, or send the CoAP request to another instance of the CoAP proxy and
+	// receive a response
+	resBody, statusCode, observed, err := p.observeSync(ctx, c, u, match, accessToken, routeName, prio)
+	if !observed && err == nil && routeName == "send_transaction" && p.batching != nil && c.batchable && origin != nil {
+		// Federation transactions to a proxy which accepts batches of them are
+		// sent along with the other ones the homeserver sends it meanwhile
+		txnID := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		return p.batching.add(req.Target, *origin, txnID, u, decodedBody, prio)
+	}
+	if !observed && err == nil {
+		path := coapPathFor(c, u, match, accessToken)
+		common.Debugf("Final path: %s", path)
+
+		resBody, statusCode, err = p.sendCoAPRequest(ctx, c, req.Target, method, path, routeName, prio, decodedBody, origin)
+	}
+
+	return
+}
+
+// storeAndForward is a function that queues the given request to be sent once
+// its proxy can be reached, and answers it with the status in the options
+// (202 Accepted by default), or with a 502 if it can't be queued. err is the error which prevented it from
+// being sent, if any.
+func (p *Proxy) storeAndForward(w http.ResponseWriter, req *proxiedRequest, serverSpan opentracing.Span, err error) {
+	if err != nil {
+		log.Printf("WARNING: Failed to send %s %s to %s, queuing it: %v", req.Method, req.URI, req.Target, err)
+	}
+
+	queued, qErr := p.forwarding.enqueue(req)
+	if qErr != nil {
+		log.Printf("ERROR: Failed to queue %s %s: %v", req.Method, req.URI, qErr)
+	} else if !queued {
+		log.Printf("WARNING: Queue of %s is full, not queuing %s %s", req.Target, req.Method, req.URI)
+	}
+
+	if !queued {
+		if err == nil {
+			err = errQueueFull
+		}
+		handleErr(err, serverSpan)
+		writeMatrixError(w, http.StatusBadGateway, "M_UNKNOWN", err.Error())
+		return
+	}
+
+	serverSpan.SetTag("store_forward", true)
+	writeJSON(w, p.opts.StoreForward.Status, map[string]interface{}{})
+}
+
+// coapPathFor is a function that returns the path to send the CoAP request for
+// the given URL on over the given connection, compressed with the given match
+// if the remote proxy has the same maps as us, and with the given access token
+// if any.
+func coapPathFor(c *openConn, u *url.URL, match *routeMatch, accessToken string) string {
+	var path string
+	if c.compat == mapsMatch {
+		// Generate a compressed path, using the found route if any
+		path = c.maps.genCompressedPath(u, match)
+	} else {
+		// The remote proxy wouldn't understand a path compressed with our maps
+		path = u.Path
+		if len(u.RawQuery) > 0 {
+			path = path + "?" + u.Query().Encode()
+		}
+	}
+
+	if len(accessToken) > 0 {
+		var sep string
+		if strings.Contains(path, "?") {
+			sep = "&"
+		} else {
+			sep = "?"
+		}
+
+		path = path + sep + "access_token=" + accessToken
+	}
+
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	return path
+}
+
+// writeMatrixError is a function that responds to an HTTP request with the
+// given status code and a Matrix error body.
+func writeMatrixError(w http.ResponseWriter, statusCode int, errcode string, msg string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, statusCode, map[string]string{
+		"errcode": errcode,
+		"error":   msg,
+	})
+}
+
+// writeJSON is a function that responds to an HTTP request with the given
+// status code and the JSON encoding of the given body.
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if _, err := w.Write(json.Encode(body)); err != nil {
+		log.Printf("Failed to write HTTP response: %s", err.Error())
+	}
+}
+
+// sendHTTPRequest is a function that sends an HTTP request to a homeserver
+// either from a client or another homeserver in the case of federation.
+func (p *Proxy) sendHTTPRequest(
+	ctx context.Context, method string, path string, payload []byte, origin string,
+) (resBody []byte, statusCode int, err error) {
+	// OpenTracing setup
+	span, ctx := opentracing.StartSpanFromContext(ctx, "http_request")
+	defer span.Finish()
+
+	ext.SpanKindRPCClient.Set(span)
+
+	// Create the request
+	url := fmt.Sprintf("%s%s", p.opts.HTTPTarget, path)
+	hReq, err := http.NewRequest(strings.ToUpper(method), url, bytes.NewReader(payload))
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(olog.Error(err))
+		return
+	}
+	hReq = hReq.WithContext(ctx)
+
+	// Set headers
+	hReq.Header.Add("Content-Type", "application/json")
+	if len(origin) > 0 {
+		hReq.Header.Add("Authorization", fedAuthPrefix+origin+fedAuthSuffix)
+	}
+
+	// Record request details in OpenTracing
+	ext.HTTPMethod.Set(span, method)
+	ext.HTTPUrl.Set(span, path)
+	_ = opentracing.GlobalTracer().Inject(
+		span.Context(),
+		opentracing.HTTPHeaders,
+		opentracing.HTTPHeadersCarrier(hReq.Header),
+	)
+
+	// Perform the request and receive the response
+	hRes, err := httpClient.Do(hReq)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(olog.Error(err))
+		return
+	}
+
+	// Receive the response body
+	resBody, err = ioutil.ReadAll(hRes.Body)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(olog.Error(err))
+		return
+	}
+
+	if len(resBody) > 0 {
+		contentType := hRes.Header.Get("content-type")
+		common.Debugf("Got response with content type: %s", contentType)
+
+		if contentType != "application/json" {
+			common.Debug("Got non-json request, ignoring")
+
+			statusCode = 502
+			resBody = []byte{}
+			return
+		}
+	}
+
+	// Record response status code in OpenTracing
+	ext.HTTPStatusCode.Set(span, uint16(hRes.StatusCode))
+
+	statusCode = hRes.StatusCode
+
+	return
+}
@@ -0,0 +1,569 @@
+package proxy
+
+import (
+	encjson "encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/coap-proxy/common"
+	"github.com/matrix-org/coap-proxy/types"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// Values for Options.MapsMismatch
+const (
+	// MapsMismatchFallback sends paths and payloads uncompressed to proxies
+	// with different maps.
+	MapsMismatchFallback = "fallback"
+	// MapsMismatchRefuse refuses to talk to proxies with different maps.
+	MapsMismatchRefuse = "refuse"
+)
+
+// versionFilters are the filters of the maps files which hold attributes that
+// only matter to one of the proxies, which are left out of the maps set's
+// version so changing them doesn't require upgrading the maps across the
+// network.
+var versionFilters = map[string]types.VersionFilter{
+	"routes.json": versionedRoutes,
+}
+
+// encodingRouteNames are the names of the routes whose requests or responses
+// have their payload compressed in a specific way, which both proxies must
+// therefore agree on: transactions have their PDUs and destination tables
+// compressed. Syncs have the server names of their identifiers interned too,
+// but these are tagged so they're restored whatever the route's name.
+var encodingRouteNames = map[string]bool{
+	"send_transaction": true,
+}
+
+// mapsHandshakePath is the path proxies exchange their maps version on. It
+// can't be mistaken for a compressed route as it isn't a base 32 integer.
+const mapsHandshakePath = "/_maps"
+
+// mapFiles are all of the files in the maps directory which affect how paths
+// and payloads are compressed, and therefore the maps set's version.
+var mapFiles = []string{
+	"routes.json",
+	"query_params.json",
+	"event_types.json",
+	"common_keys.json",
+	"error_codes.json",
+	"edu_types.json",
+	"common_values.json",
+	"extra_flate_data",
+}
+
+// Files in the maps directory which are concatenated into the flate dictionary
+var dictFiles = []string{
+	"event_types.json",
+	"common_keys.json",
+	"error_codes.json",
+	"edu_types.json",
+}
+
+// mapSet is a struct holding everything loaded from the maps directory, which
+// is used to compress paths and payloads.
+type mapSet struct {
+	dir         string
+	version     string
+	routes      []route
+	router      *routeTrie
+	eventTypes  []string
+	queryParams []string
+	compressor  *types.Compressor
+}
+
+// mapGenerations is a struct holding every generation of the maps we support,
+// so that we can keep talking to proxies which haven't been upgraded to the
+// newest one yet.
+type mapGenerations struct {
+	sets []*mapSet // sets is ordered from the newest to the oldest generation
+}
+
+// loadedMaps is a function that returns the maps currently in use.
+func (p *Proxy) loadedMaps() *mapGenerations {
+	return p.currentMaps.Load().(*mapGenerations)
+}
+
+// loadGenerations is a function that parses and validates the maps in each of
+// the given directories, ordered from the newest to the oldest generation, for
+// use with the given compression backend.
+func loadGenerations(dirs []string, backend string) (*mapGenerations, error) {
+	gens := new(mapGenerations)
+	tags := make(map[uint16]string)
+
+	for _, dir := range dirs {
+		ms, err := loadMaps(dir, backend)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", dir, err)
+		}
+
+		if other, exists := tags[ms.compressor.Tag()]; exists {
+			if other == ms.version {
+				return nil, fmt.Errorf("%s: version %s is loaded twice", dir, ms.version)
+			}
+
+			return nil, fmt.Errorf(
+				"%s: version %s can't be told apart from version %s", dir, ms.version, other,
+			)
+		}
+		tags[ms.compressor.Tag()] = ms.version
+
+		gens.sets = append(gens.sets, ms)
+	}
+
+	return gens, nil
+}
+
+// warnNoServerNames is a function that logs a warning for each generation of
+// the maps which doesn't list any server name, as destination tables and
+// identifiers are then never compressed with them.
+func (gens *mapGenerations) warnNoServerNames() {
+	for _, ms := range gens.sets {
+		if len(ms.compressor.ServerNames()) == 0 {
+			log.Printf(
+				"WARNING: Maps version %s doesn't list any server name, so server names are always sent in full; see gen-maps --server-names",
+				ms.version,
+			)
+		}
+	}
+}
+
+// newest is a function that returns the newest generation of the maps.
+func (gens *mapGenerations) newest() *mapSet {
+	return gens.sets[0]
+}
+
+// byVersion is a function that returns the generation of the maps with the
+// given version, or nil if there's none.
+func (gens *mapGenerations) byVersion(version string) *mapSet {
+	for _, ms := range gens.sets {
+		if ms.version == version {
+			return ms
+		}
+	}
+
+	return nil
+}
+
+// byTag is a function that returns the generation of the maps which
+// dictionary has the given tag, or nil if there's none.
+func (gens *mapGenerations) byTag(tag uint16) *mapSet {
+	for _, ms := range gens.sets {
+		if ms.compressor.Tag() == tag {
+			return ms
+		}
+	}
+
+	return nil
+}
+
+// shared is a function that returns the first generation of the maps, in the
+// order of the given preferred versions, which is both ours and in the given
+// other versions, or nil if there's none. Both ends of a connection use the
+// versions of the proxy which initiated it as the preferred ones, so they
+// agree on which generation to use.
+func (gens *mapGenerations) shared(preferred []string, other []string) *mapSet {
+	for _, version := range preferred {
+		ms := gens.byVersion(version)
+		if ms == nil {
+			continue
+		}
+
+		for _, v := range other {
+			if v == version {
+				return ms
+			}
+		}
+	}
+
+	return nil
+}
+
+// versions is a function that returns the versions of all of the generations
+// of the maps, from the newest to the oldest.
+func (gens *mapGenerations) versions() []string {
+	versions := make([]string, 0, len(gens.sets))
+	for _, ms := range gens.sets {
+		versions = append(versions, ms.version)
+	}
+
+	return versions
+}
+
+// compressors is a function that returns the compressors of all of the
+// generations of the maps.
+func (gens *mapGenerations) compressors() []*types.Compressor {
+	comps := make([]*types.Compressor, 0, len(gens.sets))
+	for _, ms := range gens.sets {
+		comps = append(comps, ms.compressor)
+	}
+
+	return comps
+}
+
+// mapsDirs is a function that returns the directories to load the maps from,
+// from the newest to the oldest generation.
+func (opts Options) mapsDirs() []string {
+	return append([]string{opts.MapsDir}, opts.PreviousMapsDirs...)
+}
+
+// versionedRoutes is a function that returns the attributes of the routes in
+// the given routes.json which affect how paths and payloads are compressed:
+// their path and method, in order, and their name if it's one of
+// encodingRouteNames. A route's priority only matters to the proxy sending a
+// request on it, and its max age to the one answering it, which tells the
+// other.
+func versionedRoutes(b []byte) ([]byte, error) {
+	var routes []route
+	if err := encjson.Unmarshal(b, &routes); err != nil {
+		return nil, err
+	}
+
+	versioned := make([][]string, 0, len(routes))
+	for _, r := range routes {
+		attrs := []string{r.Path, r.Method}
+		if encodingRouteNames[r.Name] {
+			attrs = append(attrs, r.Name)
+		}
+		versioned = append(versioned, attrs)
+	}
+
+	return encjson.Marshal(versioned)
+}
+
+// loadMaps is a function that parses and validates the maps in the given
+// directory, for use with the given compression backend.
+func loadMaps(dir string, backend string) (ms *mapSet, err error) {
+	ms = new(mapSet)
+	ms.dir = dir
+
+	files := mapFiles
+	if backend == types.BackendZstd {
+		// zstd's trained dictionary is optional.
+		if _, err = os.Stat(filepath.Join(dir, types.ZstdDictFile)); err == nil {
+			files = append(files, types.ZstdDictFile)
+		}
+	}
+
+	// So is the server names registry.
+	if _, err = os.Stat(filepath.Join(dir, types.ServerNamesFile)); err == nil {
+		files = append(files, types.ServerNamesFile)
+	}
+
+	if ms.version, err = types.MapsVersion(dir, files, backend, versionFilters); err != nil {
+		return nil, err
+	}
+
+	if err = json.ParseFile(
+		filepath.Join(dir, "routes.json"),
+		&ms.routes,
+	); err != nil {
+		return nil, err
+	}
+
+	if err = json.ParseFile(
+		filepath.Join(dir, "query_params.json"),
+		&ms.queryParams,
+	); err != nil {
+		return nil, err
+	}
+
+	if err = json.ParseFile(
+		filepath.Join(dir, "event_types.json"),
+		&ms.eventTypes,
+	); err != nil {
+		return nil, err
+	}
+
+	if ms.compressor, err = types.NewCompressor(dir, dictFiles, ms.version, backend, cbor); err != nil {
+		return nil, err
+	}
+
+	if err = ms.validate(); err != nil {
+		return nil, err
+	}
+
+	ms.router = newRouteTrie(ms.routes)
+
+	return ms, nil
+}
+
+// validate is a function that checks the maps can be used to compress and
+// decompress paths.
+func (ms *mapSet) validate() error {
+	for id, r := range ms.routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("Route #%d: path %q doesn't start with a slash", id, r.Path)
+		}
+
+		for _, seg := range strings.Split(r.Path, "/") {
+			if strings.ContainsAny(seg, "{}") && routePatternRgxp.FindString(seg) != seg {
+				return fmt.Errorf("Route #%d: segment %q mixes an argument with other characters", id, seg)
+			}
+		}
+
+		switch strings.ToUpper(r.Method) {
+		case "GET", "POST", "PUT", "DELETE":
+		default:
+			return fmt.Errorf("Route #%d: unsupported method %q", id, r.Method)
+		}
+
+		if _, err := parsePriority(r.Priority); err != nil {
+			return fmt.Errorf("Route #%d: %v", id, err)
+		}
+
+		if r.MaxAge < 0 {
+			return fmt.Errorf("Route #%d: negative max age %d", id, r.MaxAge)
+		}
+
+		if r.MaxAge > 0 && strings.ToUpper(r.Method) != "GET" {
+			return fmt.Errorf("Route #%d: only GET routes can have a max age", id)
+		}
+	}
+
+	for i, qp := range ms.queryParams {
+		if len(qp) == 0 {
+			return fmt.Errorf("Query parameter #%d is empty", i)
+		}
+	}
+
+	for i, t := range ms.eventTypes {
+		if len(t) == 0 {
+			return fmt.Errorf("Event type #%d is empty", i)
+		}
+	}
+
+	return nil
+}
+
+// ReloadMaps is a function that loads the maps again from the maps directory
+// and the previous generations' directories and, if they are valid, swaps them
+// with the ones in use. Requests being processed keep using the previous maps,
+// and connections to other proxies are replaced once their ongoing exchanges
+// are over so the maps get negotiated again.
+func (p *Proxy) ReloadMaps() error {
+	p.reloadMut.Lock()
+	defer p.reloadMut.Unlock()
+
+	dirs := p.opts.mapsDirs()
+	log.Printf("Reloading compression maps from %s", strings.Join(dirs, ", "))
+
+	gens, err := loadGenerations(dirs, p.opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err = p.peers.checkMapsVersions(gens); err != nil {
+		return err
+	}
+
+	versions := strings.Join(gens.versions(), ", ")
+	if prev := p.loadedMaps(); strings.Join(prev.versions(), ", ") == versions {
+		log.Printf("Compression maps unchanged (versions %s)", versions)
+		return nil
+	}
+
+	p.currentMaps.Store(gens)
+	p.serverTransport.SetCompressors(gens.compressors())
+
+	log.Printf("Finished reloading compression maps (versions %s)", versions)
+	gens.warnNoServerNames()
+
+	return nil
+}
+
+// errMapsMismatch is returned when trying to talk to a proxy with different
+// maps while configured to refuse to.
+var errMapsMismatch = errors.New("Remote proxy uses different maps")
+
+// mapsCompat describes whether a remote proxy's maps match ours.
+type mapsCompat int
+
+const (
+	// mapsMatch means both proxies have the same maps and can use them to
+	// compress paths and payloads.
+	mapsMatch mapsCompat = iota
+	// mapsFallback means the maps differ, and paths and payloads are sent
+	// uncompressed.
+	mapsFallback
+	// mapsRefused means the maps differ, and we won't talk to the proxy.
+	mapsRefused
+)
+
+// negotiateMaps is a function that sends the versions of our maps to the
+// remote proxy, retrieves its own and decides how to talk to it accordingly,
+// i.e. using the newest generation of the maps we both have.
+// This must be the first exchange on the connection, as it is sent without
+// using any dictionary so the remote proxy can read it whatever maps it has.
+func (c *openConn) negotiateMaps() error {
+	ours := c.gens.versions()
+	if c.peer != nil && len(c.peer.MapsVersion) > 0 {
+		// Only offer the version pinned for this peer, so we either use it or
+		// don't use any.
+		ours = []string{c.peer.MapsVersion}
+	}
+
+	pl, err := c.gens.newest().compressor.CompressPayloadNoDict(cbor.Encode(ours))
+	if err != nil {
+		return err
+	}
+
+	req := c.NewMessage(coap.MessageParams{
+		Type:      coap.Confirmable,
+		Code:      coap.POST,
+		MessageID: uint16(r1.Intn(100000)),
+		Token:     randSlice(2),
+		Payload:   pl,
+	})
+	req.SetOption(coap.ContentFormat, coap.AppOctets)
+	req.SetPathString(mapsHandshakePath)
+
+	res, err := c.Exchange(req)
+	if err != nil {
+		return err
+	}
+
+	theirs, err := decodeMapsVersions(c.gens, res.Payload())
+	if err != nil {
+		return err
+	}
+
+	target := c.RemoteAddr().String()
+
+	// Paths and payloads which aren't compressed with the maps still need a
+	// generation of the maps to be parsed, so use the newest one if we don't
+	// have any generation in common.
+	c.maps = c.gens.newest()
+
+	switch shared := c.gens.shared(ours, theirs); {
+	case shared != nil:
+		if shared != c.gens.newest() {
+			log.Printf(
+				"Using previous maps version %s with %s (ours: %s, theirs: %s)",
+				shared.version, target, strings.Join(ours, ", "), strings.Join(theirs, ", "),
+			)
+		} else {
+			common.Debugf("Using maps version %s with %s", shared.version, target)
+		}
+		c.maps = shared
+		c.compat = mapsMatch
+		c.transport.SetTag(shared.compressor.Tag())
+	case c.proxy.opts.MapsMismatch == MapsMismatchRefuse || res.Code() == coap.PreconditionFailed:
+		log.Printf(
+			"ERROR: Maps version mismatch with %s (ours: %s, theirs: %s), refusing to talk to it",
+			target, strings.Join(ours, ", "), strings.Join(theirs, ", "),
+		)
+		c.compat = mapsRefused
+	default:
+		log.Printf(
+			"WARNING: Maps version mismatch with %s (ours: %s, theirs: %s), falling back to uncompressed paths and payloads",
+			target, strings.Join(ours, ", "), strings.Join(theirs, ", "),
+		)
+		c.compat = mapsFallback
+	}
+
+	// Proxies which let us observe syncs say so with an Observe option, which
+	// older ones ignore.
+	c.observable = res.Option(coap.Observe) != nil
+
+	// Likewise for proxies which accept batches of transactions, which say so
+	// with a LocationQuery option.
+	c.batchable = false
+	for _, v := range res.Options(coap.LocationQuery) {
+		if v == batchCapability {
+			c.batchable = true
+		}
+	}
+
+	return nil
+}
+
+// serveMapsHandshake is a function that answers a remote proxy telling us the
+// versions of its maps with the versions of ours, and whether we're willing to
+// talk to it.
+func (p *Proxy) serveMapsHandshake(w coap.ResponseWriter, req *coap.Request) {
+	gens := p.loadedMaps()
+	ours := gens.versions()
+
+	theirs, err := decodeMapsVersions(gens, req.Msg.Payload())
+	if err != nil {
+		log.Printf("ERROR: Invalid maps handshake from %s: %v", req.Client.RemoteAddr(), err)
+		w.SetCode(coap.BadRequest)
+		_, _ = w.Write(nil)
+		return
+	}
+
+	code := coap.Content
+	if gens.shared(theirs, ours) == nil {
+		if p.opts.MapsMismatch == MapsMismatchRefuse {
+			log.Printf(
+				"ERROR: Maps version mismatch with %s (ours: %s, theirs: %s), refusing its requests",
+				req.Client.RemoteAddr(), strings.Join(ours, ", "), strings.Join(theirs, ", "),
+			)
+			code = coap.PreconditionFailed
+		} else {
+			log.Printf(
+				"WARNING: Maps version mismatch with %s (ours: %s, theirs: %s), accepting uncompressed requests",
+				req.Client.RemoteAddr(), strings.Join(ours, ", "), strings.Join(theirs, ", "),
+			)
+		}
+	}
+
+	pl, err := gens.newest().compressor.CompressPayloadNoDict(cbor.Encode(ours))
+	if err != nil {
+		log.Printf("ERROR: Failed to compress maps handshake response: %v", err)
+		return
+	}
+
+	res := w.NewResponse(code)
+	res.SetOption(coap.ContentFormat, coap.AppOctets)
+	res.SetPayload(pl)
+	if p.opts.ObserveSync {
+		res.SetOption(coap.Observe, 0)
+	}
+	res.SetOption(coap.LocationQuery, batchCapability)
+
+	if err = w.WriteMsg(res); err != nil {
+		log.Printf("ERROR: Failed to send maps handshake response: %v", err)
+	}
+}
+
+// decodeMapsVersions is a function that retrieves the versions of the maps
+// from the payload of a maps handshake request or response.
+func decodeMapsVersions(gens *mapGenerations, pl []byte) ([]string, error) {
+	pl, err := gens.newest().compressor.DecompressPayload(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pl) == 0 {
+		return nil, errors.New("Empty maps handshake payload")
+	}
+
+	body, err := decodeCBOR(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	slice, ok := body.([]interface{})
+	if !ok || len(slice) == 0 {
+		return nil, errors.New("Maps versions aren't a non-empty list")
+	}
+
+	versions := make([]string, 0, len(slice))
+	for _, v := range slice {
+		version, ok := v.(string)
+		if !ok {
+			return nil, errors.New("Maps version isn't a string")
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+// errorMessages are the human-readable messages put back into Matrix error
+// responses which had theirs dropped by the remote proxy, by error code.
+var errorMessages = map[string]string{
+	"M_BAD_JSON":                        "Request contained valid JSON, but it was malformed in some way",
+	"M_BAD_STATE":                       "The state change requested cannot be performed",
+	"M_CANNOT_LEAVE_SERVER_NOTICE_ROOM": "Cannot leave the server notices room",
+	"M_CAPTCHA_INVALID":                 "The Captcha provided did not match what was expected",
+	"M_CAPTCHA_NEEDED":                  "A Captcha is required to complete the request",
+	"M_CONSENT_NOT_GIVEN":               "Consent to the privacy policy is required",
+	"M_EXAMPLE_ERROR":                   "Example error",
+	"M_EXCLUSIVE":                       "The resource is reserved by an application service",
+	"M_FORBIDDEN":                       "Forbidden",
+	"M_GUEST_ACCESS_FORBIDDEN":          "Guest access is not allowed",
+	"M_INCOMPATIBLE_ROOM_VERSION":       "The server does not support the room's version",
+	"M_INVALID_PARAM":                   "A parameter that was specified has the wrong value",
+	"M_INVALID_ROOM_STATE":              "The room's state is invalid",
+	"M_INVALID_USERNAME":                "The desired user ID is not a valid user name",
+	"M_LIMIT_EXCEEDED":                  "Too many requests have been sent in a short period of time",
+	"M_MISSING_PARAM":                   "A required parameter was missing from the request",
+	"M_MISSING_TOKEN":                   "No access token was specified for the request",
+	"M_NOT_FOUND":                       "No resource was found for this request",
+	"M_NOT_JSON":                        "Request did not contain valid JSON",
+	"M_RESOURCE_LIMIT_EXCEEDED":         "The server has exceeded a resource limit",
+	"M_ROOM_IN_USE":                     "The room alias is already taken",
+	"M_SERVER_NOT_TRUSTED":              "The server is not trusted",
+	"M_THREEPID_AUTH_FAILED":            "The third party identifier could not be authenticated",
+	"M_THREEPID_DENIED":                 "The third party identifier is not allowed",
+	"M_THREEPID_IN_USE":                 "The third party identifier is already in use",
+	"M_THREEPID_NOT_FOUND":              "The third party identifier could not be found",
+	"M_TOO_LARGE":                       "The request or entity was too large",
+	"M_UNAUTHORIZED":                    "The request was not correctly authorized",
+	"M_UNKNOWN":                         "An unknown error has occurred",
+	"M_UNKNOWN_TOKEN":                   "The access token specified was not recognised",
+	"M_UNRECOGNIZED":                    "The server did not understand the request",
+	"M_UNSUPPORTED_ROOM_VERSION":        "The server does not support the room version",
+	"M_USER_IN_USE":                     "The desired user ID is already taken",
+	"M_WEAK_PASSWORD":                   "The password is too weak",
+}
+
+// defaultErrorMessage is the message put back into Matrix error responses
+// which had theirs dropped by the remote proxy if their error code isn't in
+// errorMessages.
+const defaultErrorMessage = "An error has occurred"
+
+// dropErrorMessage is a function that removes the human-readable message from
+// a Matrix error response's body, so only its error code is sent over the
+// network. Bodies without an error code are left untouched.
+func dropErrorMessage(body interface{}) {
+	bodyMap, ok := body.(map[interface{}]interface{})
+	if !ok {
+		return
+	}
+
+	if _, ok = bodyMap["errcode"].(string); ok {
+		delete(bodyMap, "error")
+	}
+}
+
+// restoreErrorMessage is a function that puts a human-readable message back
+// into a Matrix error response's body which has an error code but no message,
+// as clients expect both.
+func restoreErrorMessage(body interface{}) {
+	bodyMap, ok := body.(map[interface{}]interface{})
+	if !ok {
+		return
+	}
+
+	errcode, ok := bodyMap["errcode"].(string)
+	if !ok {
+		return
+	}
+
+	if _, exists := bodyMap["error"]; exists {
+		return
+	}
+
+	if msg, ok := errorMessages[errcode]; ok {
+		bodyMap["error"] = msg
+	} else {
+		bodyMap["error"] = defaultErrorMessage
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// metric is a struct that describes a metric exposed on the admin endpoint.
+type metric struct {
+	name string
+	help string
+	kind string
+}
+
+// rttMetric is a struct that describes a metric about the round-trip time
+// estimates of a peer, along with how to get its value from them.
+type rttMetric struct {
+	metric
+	value func(s rttSnapshot) float64
+}
+
+// linkMetric is a struct that describes a metric about the congestion control
+// of the link to a peer, along with how to get its value from its state.
+type linkMetric struct {
+	metric
+	value func(s linkSnapshot) float64
+}
+
+// rttMetrics is the list of the metrics about the round-trip time estimates of
+// the peers.
+var rttMetrics = []rttMetric{
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_smoothed_seconds",
+			help: "Smoothed round-trip time to the peer, from messages which weren't retransmitted.",
+			kind: "gauge",
+		},
+		value: func(s rttSnapshot) float64 { return s.strong.srtt.Seconds() },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_variation_seconds",
+			help: "Round-trip time variation to the peer, from messages which weren't retransmitted.",
+			kind: "gauge",
+		},
+		value: func(s rttSnapshot) float64 { return s.strong.rttvar.Seconds() },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_weak_smoothed_seconds",
+			help: "Smoothed round-trip time to the peer, from retransmitted messages.",
+			kind: "gauge",
+		},
+		value: func(s rttSnapshot) float64 { return s.weak.srtt.Seconds() },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_weak_variation_seconds",
+			help: "Round-trip time variation to the peer, from retransmitted messages.",
+			kind: "gauge",
+		},
+		value: func(s rttSnapshot) float64 { return s.weak.rttvar.Seconds() },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_samples_total",
+			help: "Number of messages to the peer which measured a round-trip time.",
+			kind: "counter",
+		},
+		value: func(s rttSnapshot) float64 { return float64(s.strong.samples + s.weak.samples) },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_rtt_weak_samples_total",
+			help: "Number of messages to the peer which were retransmitted.",
+			kind: "counter",
+		},
+		value: func(s rttSnapshot) float64 { return float64(s.weak.samples) },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_retransmission_timeout_seconds",
+			help: "Estimated retransmission timeout of the peer, before bounding it with the retry options.",
+			kind: "gauge",
+		},
+		value: func(s rttSnapshot) float64 { return s.rto.Seconds() },
+	},
+}
+
+// linkMetrics is the list of the metrics about the congestion control of the
+// links to the peers.
+var linkMetrics = []linkMetric{
+	{
+		metric: metric{
+			name: "coap_proxy_link_outstanding_exchanges",
+			help: "Number of exchanges in flight with the peer.",
+			kind: "gauge",
+		},
+		value: func(s linkSnapshot) float64 { return float64(s.outstanding) },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_link_congestion_window",
+			help: "How many exchanges can be in flight with the peer at once, 0 for no limit.",
+			kind: "gauge",
+		},
+		value: func(s linkSnapshot) float64 { return s.window },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_link_queued_requests",
+			help: "Number of requests waiting to be sent to the peer.",
+			kind: "gauge",
+		},
+		value: func(s linkSnapshot) float64 { return float64(s.queued) },
+	},
+	{
+		metric: metric{
+			name: "coap_proxy_link_rejected_requests_total",
+			help: "Number of requests refused because too many were waiting to be sent to the peer.",
+			kind: "counter",
+		},
+		value: func(s linkSnapshot) float64 { return float64(s.rejected) },
+	},
+}
+
+// writeMetrics is a function that writes the proxy's metrics in the
+// Prometheus text format.
+func (p *Proxy) writeMetrics(w io.Writer) {
+	rttTargets := p.rtts.targets()
+	rtts := make([]rttSnapshot, len(rttTargets))
+	for i, target := range rttTargets {
+		rtts[i] = p.rtts.lookup(target).snapshot()
+	}
+
+	for _, m := range rttMetrics {
+		values := make([]float64, len(rtts))
+		for i := range rtts {
+			values[i] = m.value(rtts[i])
+		}
+		m.write(w, rttTargets, values)
+	}
+
+	linkTargets := p.links.targets()
+	links := make([]linkSnapshot, len(linkTargets))
+	for i, target := range linkTargets {
+		links[i] = p.links.lookup(target).snapshot()
+	}
+
+	for _, m := range linkMetrics {
+		values := make([]float64, len(links))
+		for i := range links {
+			values[i] = m.value(links[i])
+		}
+		m.write(w, linkTargets, values)
+	}
+}
+
+// write is a function that writes the metric in the Prometheus text format,
+// with the given value for each of the given peers.
+func (m metric) write(w io.Writer, targets []string, values []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	for i, target := range targets {
+		fmt.Fprintf(w, "%s{peer=%q} %g\n", m.name, target, values[i])
+	}
+}
+
+// serveMetrics is a function that handles requests to the metrics endpoint.
+func (p *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.writeMetrics(w)
+}
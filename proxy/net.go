@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"net/http"
@@ -9,41 +9,42 @@ import (
 	"github.com/matrix-org/go-coap"
 )
 
-// listenAndServe is a function that wraps around a CoAP server with a
-// specialised configuration and asks it to listen on the given address and
-// port.
-func listenAndServe(addr string, network string, handler coap.Handler, comp coap.Compressor) error {
+// newCoAPServer is a function that returns a CoAP server with a specialised
+// configuration, which serves requests with the given handler.
+func (p *Proxy) newCoAPServer(handler coap.Handler) *coap.Server {
 	blockWiseTransfer := true
-	blockWiseTransferSzx := coap.BlockWiseSzx1024
-	server := &coap.Server{
-		Addr:                 addr,
-		Net:                  network,
+	// The block size has been validated when creating the proxy.
+	blockWiseTransferSzx, _ := blockSizeSzx(p.opts.BlockSize)
+	return &coap.Server{
+		Net:                  "udp",
 		Handler:              handler,
 		BlockWiseTransfer:    &blockWiseTransfer,
 		BlockWiseTransferSzx: &blockWiseTransferSzx,
-		MaxMessageSize:       ^uint32(0),
-		Encryption:           !(*noEncryption),
-		KeyStore:             keyStore,
-		Compressor:           comp,
-		RetriesQueue:         retriesQueue,
+		MaxMessageSize:       coapMaxMessageSize(p.opts.MaxMessageSize),
+		Encryption:           !p.opts.DisableEncryption,
+		KeyStore:             p.keyStore,
+		Compressor:           p.serverTransport,
+		RetriesQueue:         p.retriesQueue,
 	}
-	return server.ListenAndServe()
 }
 
 // dialTimeout is a function that dials (connects to) a CoAP server as a CoAP
-// client and times out on a given timeout.Duration.
-func dialTimeout(network, address string, timeout time.Duration) (*coap.ClientConn, error) {
+// client and times out on a given timeout.Duration, with the given connection
+// settings and retries queue.
+func (p *Proxy) dialTimeout(
+	network, address string, timeout time.Duration, settings connSettings,
+	retriesQueue *coap.RetriesQueue, comp coap.Compressor,
+) (*coap.ClientConn, error) {
 	blockWiseTransfer := true
-	blockWiseTransferSzx := coap.BlockWiseSzx1024
 	client := coap.Client{
 		Net:                  network,
 		DialTimeout:          timeout,
 		BlockWiseTransfer:    &blockWiseTransfer,
-		BlockWiseTransferSzx: &blockWiseTransferSzx,
-		MaxMessageSize:       ^uint32(0),
-		Encryption:           !(*noEncryption),
-		KeyStore:             keyStore,
-		Compressor:           compressor,
+		BlockWiseTransferSzx: &settings.szx,
+		MaxMessageSize:       coapMaxMessageSize(settings.maxMessageSize),
+		Encryption:           settings.encryption,
+		KeyStore:             p.keyStore,
+		Compressor:           comp,
 		RetriesQueue:         retriesQueue,
 	}
 	return client.Dial(address)
@@ -65,6 +66,8 @@ func statusCoAPToHTTP(coapCode coap.COAPCode) uint16 {
 		return http.StatusConflict
 	case coap.Forbidden:
 		return http.StatusForbidden
+	case coap.PreconditionFailed:
+		return http.StatusPreconditionFailed
 	case coap.NotFound:
 		return http.StatusNotFound
 	case coap.MethodNotAllowed:
@@ -99,6 +102,8 @@ func statusHTTPToCoAP(httpCode int) coap.COAPCode {
 		return coap.Unauthorized
 	case http.StatusForbidden:
 		return coap.Forbidden
+	case http.StatusPreconditionFailed:
+		return coap.PreconditionFailed
 	case http.StatusNotFound:
 		return coap.NotFound
 	case http.StatusTooManyRequests:
@@ -107,6 +112,8 @@ func statusHTTPToCoAP(httpCode int) coap.COAPCode {
 		return coap.BadOption
 	case http.StatusInternalServerError:
 		return coap.InternalServerError
+	case http.StatusBadGateway:
+		return coap.BadGateway
 	default:
 		common.Debugf("Unsupported HTTP code %d", httpCode)
 		return coap.InternalServerError
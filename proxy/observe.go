@@ -0,0 +1,528 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/matrix-org/go-coap"
+)
+
+const (
+	// observeMarker is the query parameter added to the path of the syncs
+	// observed with another proxy, which tells it not to forward them to its
+	// homeserver as they are.
+	observeMarker = "coap_observe"
+	// observedSinceKey is the key added to the body of sync notifications,
+	// holding the since token of the sync they answer.
+	observedSinceKey = "XSN"
+	// observedFetchKey is the key of the body of the notifications too large
+	// to fit in a single message, which only tell the sync they answer and get
+	// fetched.
+	observedFetchKey = "XFE"
+	// observerLifetime is how long an observation lasts on the proxy doing
+	// the syncs if it isn't renewed.
+	observerLifetime = 3 * time.Minute
+	// observationRenewal is how often an observation is renewed, as long as
+	// clients keep syncing.
+	observationRenewal = time.Minute
+	// observationGrace is how long to wait for a notification on top of the
+	// sync's timeout before assuming it got lost.
+	observationGrace = 10 * time.Second
+	// maxObservedResults is how many notifications an observation keeps, for
+	// clients syncing again with a since token which has already been
+	// answered.
+	maxObservedResults = 4
+)
+
+// observation is a struct that represents the observation of a client's syncs
+// registered with another proxy (RFC 7641). The remote proxy long-polls its
+// homeserver's /sync endpoint on its own, and sends each response it gets as a
+// notification, which answers the client's sync with the since token the
+// response is for.
+type observation struct {
+	key         string
+	set         *observationSet
+	c           *openConn
+	url         url.URL
+	match       *routeMatch
+	accessToken string
+
+	mut sync.Mutex
+	obs *coap.Observation
+	// head is the since token the remote proxy is syncing with.
+	head string
+	// results holds the most recent notifications, by the since token they
+	// answer, and order their since tokens from the oldest.
+	results map[string]syncResult
+	order   []string
+	// updated is closed and replaced every time a notification arrives, and
+	// closed when the observation ends.
+	updated chan struct{}
+	ended   bool
+	// lastPoll is when a client last synced, and waiting how many syncs are
+	// waiting for a notification.
+	lastPoll time.Time
+	waiting  int
+}
+
+// syncResult is a struct that holds a sync notification. If fetch is true, the
+// notification was too large to be sent and its body needs to be fetched.
+type syncResult struct {
+	code  coap.COAPCode
+	body  interface{}
+	fetch bool
+}
+
+// observationSet is a struct that holds the ongoing observations, by remote
+// proxy and client.
+type observationSet struct {
+	mut   sync.Mutex
+	byKey map[string]*observation
+}
+
+// newObservationSet is a function that returns an empty observationSet.
+func newObservationSet() *observationSet {
+	return &observationSet{byKey: make(map[string]*observation)}
+}
+
+// observationKey is a function that returns what identifies the syncs on the
+// given URL with the given access token, i.e. the URL without the query
+// parameters which change from one sync to the next.
+func observationKey(u *url.URL, accessToken string) string {
+	q := u.Query()
+	q.Del("since")
+	q.Del("timeout")
+	q.Del(observeMarker)
+	if len(accessToken) > 0 {
+		q.Set("access_token", accessToken)
+	}
+
+	return u.Path + "?" + q.Encode()
+}
+
+// get is a function that returns the observation of the syncs on the given URL
+// with the given access token over the given connection, creating it if it
+// doesn't exist. An observation of the same syncs over another connection is
+// ended.
+func (s *observationSet) get(c *openConn, u *url.URL, match *routeMatch, accessToken string) *observation {
+	key := c.target + " " + observationKey(u, accessToken)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	o, ok := s.byKey[key]
+	if ok && o.c == c {
+		return o
+	}
+
+	if ok {
+		// It's been replaced, so it won't remove the new one.
+		go o.end()
+	}
+
+	o = &observation{
+		key:         key,
+		set:         s,
+		c:           c,
+		url:         *u,
+		match:       match,
+		accessToken: accessToken,
+		results:     make(map[string]syncResult),
+		updated:     make(chan struct{}),
+		lastPoll:    time.Now(),
+	}
+	s.byKey[key] = o
+
+	go o.maintain()
+
+	return o
+}
+
+// remove is a function that removes the given observation from the set, unless
+// it has already been replaced.
+func (s *observationSet) remove(o *observation) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.byKey[o.key] == o {
+		delete(s.byKey, o.key)
+	}
+}
+
+// closeAll is a function that ends every observation.
+func (s *observationSet) closeAll() {
+	s.mut.Lock()
+	observations := make([]*observation, 0, len(s.byKey))
+	for _, o := range s.byKey {
+		observations = append(observations, o)
+	}
+	s.mut.Unlock()
+
+	for _, o := range observations {
+		o.end()
+	}
+}
+
+// pathFor is a function that returns the path to register the observation on
+// for syncing from the given since token.
+func (o *observation) pathFor(since string) string {
+	u := o.url
+	q := u.Query()
+	q.Set("since", since)
+	q.Set(observeMarker, "1")
+	u.RawQuery = q.Encode()
+
+	return coapPathFor(o.c, &u, o.match, o.accessToken)
+}
+
+// register is a function that registers the observation with the remote
+// proxy, which syncs from the given since token, replacing any previous
+// registration.
+func (o *observation) register(since string) error {
+	common.Debugf("Observing syncs on %s since %s", o.c.target, since)
+
+	obs, err := o.c.Observe(o.pathFor(since), o.notify)
+	if err != nil {
+		return err
+	}
+
+	o.mut.Lock()
+	prev, ended := o.obs, o.ended
+	o.obs = obs
+	o.head = since
+	o.mut.Unlock()
+
+	// go-coap only stops handling the previous registration's notifications
+	// when telling the remote proxy, which ignores it as it has already
+	// replaced it with the new one.
+	if prev != nil {
+		_ = prev.Cancel()
+	}
+
+	if ended {
+		_ = obs.Cancel()
+	}
+
+	return nil
+}
+
+// notify is a function that handles a notification, or the response to the
+// registration.
+func (o *observation) notify(req *coap.Request) {
+	o.c.touch()
+
+	m := req.Msg
+
+	// The registration has been answered, but go-coap only stops
+	// retransmitting it when it gets a message with its ID, which only the
+	// acknowledgement has, and which can get lost.
+	o.c.cancelToken(m.Token())
+	if len(m.Payload()) == 0 && m.Code() == coap.Content {
+		common.Debugf("Remote proxy %s accepted the observation", o.c.target)
+		return
+	}
+
+	body, err := o.c.decodePayload(m.Payload(), "sync")
+	if err != nil {
+		log.Printf("ERROR: Failed to decode sync notification from %s: %v", o.c.target, err)
+		return
+	}
+
+	since, ok := observedSince(body)
+	if !ok {
+		// It's an error answering the registration.
+		log.Printf("WARNING: Remote proxy %s refused to observe syncs with code %s", o.c.target, m.Code())
+		o.end()
+		return
+	}
+
+	common.Debugf("Got sync notification from %s for since token %s", o.c.target, since)
+
+	if bodyMap, ok := body.(map[interface{}]interface{}); ok && bodyMap[observedFetchKey] != nil {
+		o.addResult(since, syncResult{code: m.Code(), fetch: true})
+	} else {
+		o.addResult(since, syncResult{code: m.Code(), body: body})
+	}
+
+	// The remote proxy stops syncing after an error.
+	if m.Code() != coap.Content {
+		o.end()
+		return
+	}
+
+	if next, ok := nextBatch(body); ok {
+		o.mut.Lock()
+		if o.head == since {
+			o.head = next
+		}
+		o.mut.Unlock()
+	}
+}
+
+// addResult is a function that records the given notification answering syncs
+// with the given since token, and wakes up the syncs waiting for it.
+func (o *observation) addResult(since string, res syncResult) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	if o.ended {
+		return
+	}
+
+	if _, ok := o.results[since]; !ok {
+		o.order = append(o.order, since)
+		if len(o.order) > maxObservedResults {
+			delete(o.results, o.order[0])
+			o.order = o.order[1:]
+		}
+	}
+	o.results[since] = res
+
+	close(o.updated)
+	o.updated = make(chan struct{})
+}
+
+// wait is a function that waits for the notification answering syncs with the
+// given since token, for up to patience, or until the given context is done.
+// The remote proxy is told to sync from that since token if it isn't already,
+// and again if the notification doesn't come in time in case it got lost. It
+// returns false if the notification didn't come or if the observation ended,
+// in which case the sync needs to be sent as it is.
+func (o *observation) wait(
+	ctx context.Context, since string, patience time.Duration,
+) (res syncResult, ok bool, err error) {
+	o.mut.Lock()
+	o.waiting++
+	o.mut.Unlock()
+
+	defer func() {
+		o.mut.Lock()
+		o.waiting--
+		o.lastPoll = time.Now()
+		o.mut.Unlock()
+	}()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		o.mut.Lock()
+		res, ok = o.results[since]
+		ended := o.ended
+		register := o.obs == nil || o.head != since || attempt > 0
+		o.mut.Unlock()
+
+		if ok || ended {
+			return
+		}
+
+		if register {
+			if err = o.register(since); err != nil {
+				log.Printf("WARNING: Failed to observe syncs on %s: %v", o.c.target, err)
+				o.end()
+				return res, false, nil
+			}
+		}
+
+		timer := time.NewTimer(patience)
+		res, ok, err = o.await(ctx, since, timer.C)
+		timer.Stop()
+
+		if ok || err != nil {
+			return
+		}
+	}
+
+	common.Debugf("Gave up on the sync notification from %s for since token %s", o.c.target, since)
+
+	return res, false, nil
+}
+
+// await is a function that waits for the notification answering syncs with the
+// given since token until the observation ends, the given channel fires or the
+// given context is done.
+func (o *observation) await(
+	ctx context.Context, since string, expired <-chan time.Time,
+) (syncResult, bool, error) {
+	for {
+		o.mut.Lock()
+		res, ok := o.results[since]
+		ended, updated := o.ended, o.updated
+		o.mut.Unlock()
+
+		if ok || ended {
+			return res, ok, nil
+		}
+
+		select {
+		case <-updated:
+		case <-expired:
+			return res, false, nil
+		case <-ctx.Done():
+			return res, false, ctx.Err()
+		}
+	}
+}
+
+// maintain is a function that renews the observation every observationRenewal
+// until no client has synced in that time, or its connection is closed, then
+// ends it.
+func (o *observation) maintain() {
+	ticker := time.NewTicker(observationRenewal)
+	defer ticker.Stop()
+
+	for {
+		o.mut.Lock()
+		updated := o.updated
+		o.mut.Unlock()
+
+		select {
+		case <-o.c.killswitch:
+			o.end()
+			return
+		case <-updated:
+			if o.isEnded() {
+				return
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		o.mut.Lock()
+		idle := time.Since(o.lastPoll)
+		waiting := o.waiting
+		head, registered := o.head, o.obs != nil
+		o.mut.Unlock()
+
+		if waiting == 0 && idle >= observationRenewal {
+			common.Debugf("No sync on %s for %v, ending the observation", o.c.target, idle)
+			o.end()
+			return
+		}
+
+		if !registered {
+			continue
+		}
+
+		if err := o.register(head); err != nil {
+			log.Printf("WARNING: Failed to renew the observation of syncs on %s: %v", o.c.target, err)
+			o.end()
+			return
+		}
+	}
+}
+
+// isEnded is a function that returns whether the observation has ended.
+func (o *observation) isEnded() bool {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	return o.ended
+}
+
+// end is a function that deregisters the observation from the remote proxy,
+// and lets the syncs waiting for a notification be sent as they are.
+func (o *observation) end() {
+	o.mut.Lock()
+	if o.ended {
+		o.mut.Unlock()
+		return
+	}
+	o.ended = true
+	close(o.updated)
+	obs := o.obs
+	o.mut.Unlock()
+
+	o.set.remove(o)
+
+	if obs != nil {
+		// This fails if the connection is closed, which ends the observation
+		// on the remote proxy anyway once it expires.
+		_ = obs.Cancel()
+	}
+
+	common.Debugf("Ended the observation of syncs on %s", o.c.target)
+}
+
+// observedSince is a function that removes the since token added by the
+// remote proxy from the given notification's body, and returns it.
+func observedSince(body interface{}) (string, bool) {
+	bodyMap, ok := body.(map[interface{}]interface{})
+	if !ok {
+		return "", false
+	}
+
+	since, ok := bodyMap[observedSinceKey].(string)
+	delete(bodyMap, observedSinceKey)
+
+	return since, ok
+}
+
+// nextBatch is a function that returns the since token to sync from after the
+// given sync response.
+func nextBatch(body interface{}) (string, bool) {
+	bodyMap, ok := body.(map[interface{}]interface{})
+	if !ok {
+		return "", false
+	}
+
+	next, ok := bodyMap["next_batch"].(string)
+	return next, ok && len(next) > 0
+}
+
+// observeSync is a function that answers a client's sync from the notifications
+// of an observation of its syncs registered with the remote proxy, if syncs are
+// observed and it's a long-polling one. It returns false if the sync needs to
+// be sent as it is.
+func (p *Proxy) observeSync(
+	ctx context.Context, c *openConn, u *url.URL, match *routeMatch, accessToken, routeName string,
+	prio priority,
+) (resBody interface{}, statusCode coap.COAPCode, observed bool, err error) {
+	if !p.opts.ObserveSync || routeName != "sync" || c.compat != mapsMatch || !c.observable {
+		return
+	}
+
+	q := u.Query()
+	since := q.Get("since")
+	timeout, _ := strconv.Atoi(q.Get("timeout"))
+	if len(since) == 0 || timeout <= 0 {
+		return
+	}
+
+	o := p.observations.get(c, u, match, accessToken)
+
+	patience := time.Duration(timeout)*time.Millisecond + observationGrace
+	res, ok, err := o.wait(ctx, since, patience)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	if !ok {
+		common.Debugf("Sending the sync on %s as it is", c.target)
+		return nil, 0, false, nil
+	}
+
+	if !res.fetch {
+		// The result can answer several syncs, and the body gets modified
+		// when sent back, so each of them gets a copy.
+		return cbor.Decode(cbor.Encode(res.body)), res.code, true, nil
+	}
+
+	common.Debugf("Fetching the sync notification from %s for since token %s", c.target, since)
+
+	resBody, statusCode, err = p.sendCoAPRequest(ctx, c, c.target, "GET", o.pathFor(since), routeName, prio, nil, nil)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	// The remote proxy only keeps a few notifications, and may have moved on.
+	if fetched, ok := observedSince(resBody); !ok || fetched != since {
+		common.Debugf("Sync notification from %s for since token %s is gone, sending the sync as it is", c.target, since)
+		return nil, 0, false, nil
+	}
+
+	return resBody, statusCode, true, nil
+}
@@ -0,0 +1,454 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// observer is a struct that represents an observation of a client's syncs
+// registered by another proxy. It long-polls the homeserver's /sync endpoint
+// and sends each response to the other proxy as a notification.
+type observer struct {
+	key string
+	set *observerSet
+	p   *Proxy
+
+	mut    sync.Mutex
+	client *coap.ClientCommander
+	token  []byte
+	// blockSize is the size of the largest notification which can be sent in
+	// a single message to the other proxy.
+	blockSize int
+	ms        *mapSet
+	usesDict  bool
+	// since is the since token being synced from, and expires when the
+	// observation ends unless it's renewed.
+	since   string
+	expires time.Time
+	// seq is the sequence number of the last notification sent.
+	seq uint32
+	// results holds the payloads of the most recent notifications, by the
+	// since token they answer, for the other proxy to fetch the ones too
+	// large to fit in a single message. order holds their since tokens from
+	// the oldest.
+	results map[string]notification
+	order   []string
+	// cancel stops syncing from since.
+	cancel context.CancelFunc
+}
+
+// notification is a struct that holds the code and payload of a sync
+// notification.
+type notification struct {
+	code    coap.COAPCode
+	payload []byte
+}
+
+// observerSet is a struct that holds the observations registered by other
+// proxies, by proxy and client.
+type observerSet struct {
+	mut   sync.Mutex
+	byKey map[string]*observer
+}
+
+// newObserverSet is a function that returns an empty observerSet.
+func newObserverSet() *observerSet {
+	return &observerSet{byKey: make(map[string]*observer)}
+}
+
+// observerKey is a function that returns what identifies the observation of the
+// syncs on the given URL registered by the proxy at the given address.
+func observerKey(addr net.Addr, u *url.URL) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return host + " " + observationKey(u, "")
+}
+
+// register is a function that registers the observation with the given key,
+// creating it if it doesn't exist, and returns the sequence number to answer
+// the registration with. See observer.register.
+func (s *observerSet) register(
+	p *Proxy, key string, client *coap.ClientCommander, token []byte, u *url.URL, ms *mapSet, usesDict bool,
+) uint32 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	o, ok := s.byKey[key]
+	if !ok {
+		o = &observer{key: key, set: s, p: p, results: make(map[string]notification)}
+		s.byKey[key] = o
+	}
+
+	return o.register(client, token, p.notificationBlockSize(client.RemoteAddr()), u, ms, usesDict)
+}
+
+// lookup is a function that returns the observation with the given key, if
+// any.
+func (s *observerSet) lookup(key string) *observer {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.byKey[key]
+}
+
+// deregister is a function that ends the observation registered by the proxy
+// at the given address with the given token, if any.
+func (s *observerSet) deregister(addr net.Addr, token []byte) {
+	s.mut.Lock()
+	var found *observer
+	for _, o := range s.byKey {
+		o.mut.Lock()
+		if o.client != nil && o.client.RemoteAddr().String() == addr.String() && bytes.Equal(o.token, token) {
+			found = o
+		}
+		o.mut.Unlock()
+	}
+	s.mut.Unlock()
+
+	if found != nil {
+		common.Debugf("%s deregistered the observation of %s", addr, found.key)
+		found.end()
+	}
+}
+
+// closeAll is a function that ends every observation.
+func (s *observerSet) closeAll() {
+	s.mut.Lock()
+	observers := make([]*observer, 0, len(s.byKey))
+	for _, o := range s.byKey {
+		observers = append(observers, o)
+	}
+	s.mut.Unlock()
+
+	for _, o := range observers {
+		o.end()
+	}
+}
+
+// serveSyncObservation is a function that serves a request from another proxy
+// on the syncs it observes. A registration (or renewal) starts syncing from the
+// request's since token and sending the responses as notifications, and any
+// other request fetches the latest notification.
+func (p *Proxy) serveSyncObservation(
+	w coap.ResponseWriter, req *coap.Request, u *url.URL, ms *mapSet, usesDict bool,
+) {
+	key := observerKey(req.Client.RemoteAddr(), u)
+
+	obsOpt, registering := req.Msg.Option(coap.Observe).(uint32)
+	if !registering || obsOpt != 0 {
+		var res notification
+		var ok bool
+		if o := p.observers.lookup(key); o != nil {
+			res, ok = o.result(u.Query().Get("since"))
+		}
+
+		if !ok {
+			w.SetCode(coap.NotFound)
+			_, _ = w.Write(nil)
+			return
+		}
+
+		w.SetCode(res.code)
+		w.SetContentFormat(coap.AppOctets)
+		if _, err := w.Write(res.payload); err != nil {
+			log.Printf("ERROR: Failed to send sync notification to %s: %v", req.Client.RemoteAddr(), err)
+		}
+		return
+	}
+
+	q := u.Query()
+	q.Del(observeMarker)
+	u.RawQuery = q.Encode()
+
+	seq := p.observers.register(p, key, req.Client, req.Msg.Token(), u, ms, usesDict)
+
+	res := w.NewResponse(coap.Content)
+	res.SetOption(coap.Observe, seq)
+	if err := w.WriteMsg(res); err != nil {
+		log.Printf("ERROR: Failed to accept observation from %s: %v", req.Client.RemoteAddr(), err)
+	}
+}
+
+// register is a function that registers the observation with the given client,
+// token, block size and URL, and returns the sequence number to answer the
+// registration with. Syncing starts from the URL's since token, unless it's
+// what the observation is already syncing from, in which case it's renewed.
+func (o *observer) register(
+	client *coap.ClientCommander, token []byte, blockSize int, u *url.URL, ms *mapSet, usesDict bool,
+) uint32 {
+	since := u.Query().Get("since")
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	o.client = client
+	o.token = token
+	o.blockSize = blockSize
+	o.ms = ms
+	o.usesDict = usesDict
+	o.expires = time.Now().Add(observerLifetime)
+
+	if o.cancel != nil && o.since == since {
+		common.Debugf("Renewed the observation of %s", o.key)
+		return o.seq
+	}
+
+	if o.cancel != nil {
+		o.cancel()
+	}
+
+	common.Debugf("Syncing %s since %s", o.key, since)
+
+	var ctx context.Context
+	ctx, o.cancel = context.WithCancel(context.Background())
+	o.since = since
+
+	go o.run(ctx, *u)
+
+	return o.seq
+}
+
+// run is a function that long-polls the homeserver's /sync endpoint from the
+// since token in the given URL, and sends each response as a notification,
+// until the observation is ended, expires or gets an error.
+func (o *observer) run(ctx context.Context, u url.URL) {
+	q := u.Query()
+
+	for {
+		o.mut.Lock()
+		expired := time.Now().After(o.expires)
+		o.mut.Unlock()
+
+		if expired {
+			common.Debugf("Observation of %s expired", o.key)
+			o.stop(ctx)
+			return
+		}
+
+		since := q.Get("since")
+
+		pl, statusCode, err := o.p.sendHTTPRequest(ctx, "GET", u.RequestURI(), nil, "")
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Printf("ERROR: Failed to sync %s: %v", o.key, err)
+			o.notify(ctx, since, 502, nil)
+			o.stop(ctx)
+			return
+		}
+
+		var resBody interface{}
+		if len(pl) > 0 {
+			if resBody, err = decodeJSON(pl); err != nil {
+				log.Printf("ERROR: Failed to decode sync response for %s: %v", o.key, err)
+				o.notify(ctx, since, 502, nil)
+				o.stop(ctx)
+				return
+			}
+		}
+
+		o.notify(ctx, since, statusCode, resBody)
+
+		next, ok := nextBatch(resBody)
+		if statusCode != 200 || !ok {
+			o.stop(ctx)
+			return
+		}
+
+		q.Set("since", next)
+		u.RawQuery = q.Encode()
+
+		o.mut.Lock()
+		if ctx.Err() == nil {
+			o.since = next
+		}
+		o.mut.Unlock()
+	}
+}
+
+// notify is a function that sends a notification with the given HTTP status
+// code and body, which answers the syncs with the given since token.
+func (o *observer) notify(ctx context.Context, since string, statusCode int, resBody interface{}) {
+	bodyMap, ok := resBody.(map[interface{}]interface{})
+	if !ok {
+		bodyMap = make(map[interface{}]interface{})
+	}
+	bodyMap[observedSinceKey] = since
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	// A registration may have replaced the one this notification is for while
+	// it was being synced.
+	if ctx.Err() != nil {
+		return
+	}
+
+	pl, err := o.p.encodeResponseBody(bodyMap, statusCode, "sync", o.ms, o.usesDict)
+	if err != nil {
+		log.Printf("ERROR: Failed to encode sync notification for %s: %v", o.key, err)
+		return
+	}
+
+	code := statusHTTPToCoAP(statusCode)
+	o.addResult(since, notification{code, pl})
+
+	// go-coap would send a larger notification block-wise and wait for the
+	// other proxy to ask for the next blocks, which it never does as it isn't
+	// a response to one of its requests. It only tells the sync it answers
+	// instead, and the other proxy fetches it.
+	if len(pl) > o.blockSize {
+		hint := map[interface{}]interface{}{
+			observedSinceKey: since,
+			observedFetchKey: true,
+		}
+		if next, ok := nextBatch(bodyMap); ok {
+			hint["next_batch"] = next
+		}
+
+		pl, err = o.p.encodeResponseBody(hint, statusCode, "sync", o.ms, o.usesDict)
+		if err != nil {
+			log.Printf("ERROR: Failed to encode sync notification for %s: %v", o.key, err)
+			return
+		}
+	}
+
+	o.seq++
+
+	m := o.client.NewMessage(coap.MessageParams{
+		Type:      coap.NonConfirmable,
+		Code:      code,
+		MessageID: uint16(r1.Intn(100000)),
+		Token:     o.token,
+	})
+	m.SetObserve(int(o.seq))
+	m.SetOption(coap.ContentFormat, coap.AppOctets)
+	m.SetPayload(pl)
+
+	common.Debugf("Sending sync notification #%d for %s since %s", o.seq, o.key, since)
+
+	if err = o.client.WriteMsg(m); err != nil {
+		log.Printf("ERROR: Failed to send sync notification for %s: %v", o.key, err)
+	}
+}
+
+// notificationBlockSize is a function that returns the size of the largest
+// notification which can be sent in a single message to the proxy at the given
+// address: the block size of its configuration if it's a peer, unless the CoAP
+// server's own is smaller.
+func (p *Proxy) notificationBlockSize(addr net.Addr) int {
+	size := p.connSettingsFor(nil).blockSize
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return size
+	}
+
+	if peer := p.peers.byHost(host); peer != nil {
+		if peerSize := p.connSettingsFor(peer).blockSize; peerSize < size {
+			size = peerSize
+		}
+	}
+
+	return size
+}
+
+// addResult is a function that records the payload of the notification
+// answering syncs with the given since token. It must be called with the
+// observer's lock held.
+func (o *observer) addResult(since string, res notification) {
+	if _, ok := o.results[since]; !ok {
+		o.order = append(o.order, since)
+		if len(o.order) > maxObservedResults {
+			delete(o.results, o.order[0])
+			o.order = o.order[1:]
+		}
+	}
+	o.results[since] = res
+}
+
+// result is a function that returns the code and payload of the notification
+// answering syncs with the given since token, if it's still kept.
+func (o *observer) result(since string) (notification, bool) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	res, ok := o.results[since]
+	return res, ok
+}
+
+// stop is a function that ends the observation, unless syncing from the since
+// token the given context is for has already been stopped by a new
+// registration.
+func (o *observer) stop(ctx context.Context) {
+	o.set.mut.Lock()
+	defer o.set.mut.Unlock()
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	o.cancel()
+	if o.set.byKey[o.key] == o {
+		delete(o.set.byKey, o.key)
+	}
+}
+
+// end is a function that stops syncing and forgets the observation. The latest
+// notification can't be fetched anymore once it's ended.
+func (o *observer) end() {
+	o.set.mut.Lock()
+	defer o.set.mut.Unlock()
+
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	if o.cancel != nil {
+		o.cancel()
+	}
+	if o.set.byKey[o.key] == o {
+		delete(o.set.byKey, o.key)
+	}
+}
+
+// decodeJSON is a function that decodes the given JSON payload, which the
+// homeserver may have sent invalid if it's behind a misbehaving reverse proxy.
+func decodeJSON(pl []byte) (body interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Invalid JSON: %v", r)
+		}
+	}()
+
+	return json.Decode(pl), nil
+}
+
+// decodeCBOR is a function that decodes the given CBOR payload, which another
+// proxy may have sent invalid.
+func decodeCBOR(pl []byte) (body interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Invalid CBOR: %v", r)
+		}
+	}()
+
+	return cbor.Decode(pl), nil
+}
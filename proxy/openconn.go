@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+	"github.com/matrix-org/coap-proxy/types"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// openConn is a struct that represents an open CoAP connection to another
+// coap-proxy instance. We keep a map of these for timeout tracking purposes.
+type openConn struct {
+	*coap.ClientConn
+	proxy      *Proxy
+	target     string
+	peer       *PeerOptions // peer is the target's configuration, if any
+	settings   connSettings
+	retries    *coap.RetriesQueue
+	rtt        *rttEstimator
+	lastMsg    int64 // lastMsg is accessed atomically, see touch
+	killswitch chan struct{}
+	killOnce   sync.Once
+	dead       int32 // dead is accessed atomically, see isDead
+	transport  *types.Transport
+	gens       *mapGenerations
+	maps       *mapSet
+	compat     mapsCompat
+	inFlight   sync.WaitGroup
+	observable bool // observable is whether the target lets us observe syncs
+	batchable  bool // batchable is whether the target accepts batches of transactions
+}
+
+func (p *Proxy) newOpenConn(target string) (c *openConn, err error) {
+	c = new(openConn)
+	c.proxy = p
+	c.target = target
+	c.peer = p.peers.byTarget(target)
+	c.gens = p.loadedMaps()
+	c.maps = c.gens.newest()
+	// Don't use any of our maps' dictionaries until we know which maps the
+	// remote proxy has.
+	c.transport = types.NewConnTransport(c.gens.compressors(), types.NoDictTag)
+	c.settings = p.connSettingsFor(c.peer)
+	c.rtt = p.rtts.get(target, c.settings.retries.InitialBackoff)
+	if c.settings.retries.Adaptive {
+		// go-coap can't change the backoff of a queue, so the estimate only
+		// applies to the connection's messages from when it's opened.
+		c.settings.retries = c.settings.retries.withInitialBackoff(c.rtt.snapshot().rto)
+		common.Debugf("Using an initial backoff of %v for the connection to %s", c.settings.retries.InitialBackoff, target)
+	}
+	// Each connection has its own retries queue, so its retransmissions can
+	// be cancelled without affecting other connections'.
+	c.retries = c.settings.retries.newQueue()
+
+	if c.ClientConn, err = p.dialTimeout("udp", target, 300*time.Second, c.settings, c.retries, c.transport); err != nil {
+		return
+	}
+	if timeout := c.settings.retries.exchangeTimeout(); timeout > 0 {
+		c.SetReadDeadline(timeout)
+	}
+	c.killswitch = make(chan struct{})
+
+	if err = c.negotiateMaps(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	// The handshake is over now that we got a response, but go-coap never
+	// cancels the retransmission of its first message, which would restart the
+	// handshake once the initial backoff has elapsed. Nothing else can be in
+	// flight yet since the connection isn't in the pool.
+	c.cancelRetries()
+
+	c.touch()
+
+	if p.opts.HeartbeatInterval > 0 || p.opts.IdleTimeout > 0 {
+		go c.heartbeat()
+	}
+
+	// The proxy can be reached again, so the requests queued for it can be
+	// sent
+	if p.forwarding != nil {
+		p.forwarding.kickTarget(target)
+	}
+
+	return
+}
+
+// Close is a function that stops the connection's heartbeat, if any, closes
+// the underlying CoAP connection and cancels the retransmissions of the
+// messages sent on it. It never blocks, whether a heartbeat is running or not.
+func (c *openConn) Close() error {
+	c.killOnce.Do(func() { close(c.killswitch) })
+	err := c.ClientConn.Close()
+	c.cancelRetries()
+	return err
+}
+
+// cancelRetries is a function that stops go-coap from retransmitting the
+// confirmable messages sent on the connection, which it otherwise keeps doing
+// forever for some, even after the connection is closed. The connection's
+// retries queue records the IDs of the messages it scheduled by destination,
+// including the ones of the handshake, which don't go through the transport.
+func (c *openConn) cancelRetries() {
+	// go-coap identifies destinations this way, even if it's wrong for IPv6
+	dest := strings.Split(c.ClientConn.RemoteAddr().String(), ":")[0]
+	for mID := c.retries.PopMID(dest); mID != nil; mID = c.retries.PopMID(dest) {
+		c.retries.CancelRetrySchedule(*mID)
+	}
+}
+
+// cancelExchange is a function that stops go-coap from retransmitting the
+// given request, and the blocks of it or of its response which were sent on
+// the connection, once the exchange has been given up on.
+func (c *openConn) cancelExchange(req coap.Message) {
+	c.retries.CancelRetrySchedule(req.MessageID())
+	c.cancelToken(req.Token())
+}
+
+// cancelToken is a function that stops go-coap from retransmitting the
+// messages sent on the connection with the given token.
+func (c *openConn) cancelToken(token []byte) {
+	for _, m := range c.transport.SentMessages(token) {
+		c.retries.CancelRetrySchedule(m.ID)
+	}
+}
+
+// heartbeat is a function that monitors the liveness of the connection until
+// it's closed. The connection is evicted from the pool once it hasn't been
+// used for the idle timeout, and pinged every heartbeat interval unless a
+// response was received on it in the meantime. If a ping isn't answered within
+// the heartbeat timeout, the connection is marked as dead and a new one is opened
+// (and the maps negotiated again) straight away, so the next request doesn't
+// have to wait for it.
+func (c *openConn) heartbeat() {
+	opts := c.proxy.opts
+
+	tick := opts.HeartbeatInterval
+	if tick <= 0 || (opts.IdleTimeout > 0 && opts.IdleTimeout < tick) {
+		tick = opts.IdleTimeout
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		// Wait before sending the first heartbeat so that the handshake and the
+		// first exchange can happen.
+		select {
+		case <-c.killswitch:
+			common.Debugf("Got killswitch signal for connection to %s", c.target)
+			return
+		case <-ticker.C:
+		}
+
+		idle := c.idleFor()
+
+		if opts.IdleTimeout > 0 && idle >= opts.IdleTimeout {
+			common.Debugf("Connection to %s has been idle for %v, evicting it", c.target, idle)
+			c.proxy.conns.evict(c.target, c)
+			return
+		}
+
+		if opts.HeartbeatInterval <= 0 || idle < opts.HeartbeatInterval {
+			// Either heartbeats are disabled or we got a response recently
+			// enough to know the connection is alive.
+			continue
+		}
+
+		common.Debugf("Sending heartbeat to %s", c.target)
+
+		if err := c.ClientConn.Ping(opts.HeartbeatTimeout); err != nil {
+			log.Printf("WARNING: Connection to %s is dead: %v", c.target, err)
+			atomic.StoreInt32(&c.dead, 1)
+			c.proxy.conns.redial(c.target, c)
+			return
+		}
+
+		common.Debugf("Connection to %s is alive", c.target)
+	}
+}
+
+// isDead is a function that returns whether the heartbeat found the
+// connection to be dead.
+func (c *openConn) isDead() bool {
+	return atomic.LoadInt32(&c.dead) == 1
+}
+
+// touch is a function that records that a message was just received on the
+// connection.
+func (c *openConn) touch() {
+	atomic.StoreInt64(&c.lastMsg, time.Now().UnixNano())
+}
+
+// idleFor is a function that returns how long ago the last message was received
+// on the connection.
+func (c *openConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastMsg)))
+}
+
+// coapTargetFor is a function that returns the CoAP target (address and port)
+// to send requests for the given host to.
+func (p *Proxy) coapTargetFor(host string) string {
+	// Send to the configured address if we know the host
+	if peer, ok := p.peers.byName[host]; ok {
+		return peer.Address
+	}
+
+	// Send to request's host unless the target has been forced
+	if len(p.opts.CoAPTarget) > 0 {
+		return p.opts.CoAPTarget
+	}
+
+	return host + ":" + p.opts.CoAPPort
+}
+
+// release is a function that signals that an exchange acquired from the pool
+// is over.
+func (c *openConn) release() {
+	c.inFlight.Done()
+}
+
+// retire is a function that closes the connection once the exchanges
+// happening on it are over.
+func (c *openConn) retire() {
+	c.inFlight.Wait()
+	common.Debugf("Closing UDP connection to %s", c.RemoteAddr().String())
+	_ = c.Close()
+}
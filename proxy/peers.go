@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/flynn/noise"
+	"github.com/matrix-org/go-coap"
+)
+
+// staticKeyLen is the length in bytes of noise static keys.
+const staticKeyLen = 32
+
+// PeerOptions is a struct that holds the configuration specific to another
+// proxy, which overrides the Proxy's for the connections opened to it.
+type PeerOptions struct {
+	// Name is the host of the HTTP requests to proxy to this peer, i.e. the
+	// server name of its homeserver.
+	Name string
+	// Address is the host+port to send CoAP requests for this peer to.
+	// Defaults to Name on Options.CoAPPort.
+	Address string
+	// Encryption enables or disables noise encryption on the connections to
+	// this peer, overriding Options.DisableEncryption, unless it's nil.
+	Encryption *bool
+	// MapsVersion is the only version of the maps to offer this peer when
+	// negotiating them, if set. It must be one of the loaded versions.
+	MapsVersion string
+	// BlockSize is the size in bytes of the blocks of block-wise transfers to
+	// this peer, overriding Options.BlockSize unless it's 0.
+	BlockSize int
+	// MaxMessageSize is the largest response payload to accept from this
+	// peer, overriding Options.MaxMessageSize unless it's 0.
+	MaxMessageSize int
+	// Retries is how to retransmit the messages sent to this peer, overriding
+	// Options.Retries unless it's nil.
+	Retries *RetryOptions
+	// Congestion is how to limit the traffic sent to this peer, overriding
+	// Options.Congestion unless it's nil.
+	Congestion *CongestionOptions
+}
+
+// peerSet is a struct that holds the configuration of the peers, by name and
+// by address.
+type peerSet struct {
+	byName map[string]*PeerOptions
+	byAddr map[string]*PeerOptions
+}
+
+// newPeerSet is a function that validates the configuration of the peers in
+// the given options and returns a peerSet indexing it. Peers without an
+// address get one on the default CoAP port.
+func newPeerSet(opts Options) (*peerSet, error) {
+	set := &peerSet{
+		byName: make(map[string]*PeerOptions),
+		byAddr: make(map[string]*PeerOptions),
+	}
+
+	for i := range opts.Peers {
+		peer := opts.Peers[i]
+
+		if len(peer.Name) == 0 {
+			return nil, fmt.Errorf("Peer #%d has no name", i)
+		}
+
+		if _, exists := set.byName[peer.Name]; exists {
+			return nil, fmt.Errorf("Peer %s is configured twice", peer.Name)
+		}
+
+		if len(peer.Address) == 0 {
+			peer.Address = net.JoinHostPort(peer.Name, opts.CoAPPort)
+		}
+
+		if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+			return nil, fmt.Errorf("Peer %s: invalid address %q: %v", peer.Name, peer.Address, err)
+		}
+
+		if other, exists := set.byAddr[peer.Address]; exists {
+			return nil, fmt.Errorf("Peers %s and %s have the same address %s", other.Name, peer.Name, peer.Address)
+		}
+
+		blockSize := opts.BlockSize
+		if peer.BlockSize != 0 {
+			blockSize = peer.BlockSize
+		}
+
+		if _, err := blockSizeSzx(blockSize); err != nil {
+			return nil, fmt.Errorf("Peer %s: %v", peer.Name, err)
+		}
+
+		maxMessageSize := opts.MaxMessageSize
+		if peer.MaxMessageSize != 0 {
+			maxMessageSize = peer.MaxMessageSize
+		}
+
+		if err := checkMaxMessageSize(maxMessageSize, blockSize); err != nil {
+			return nil, fmt.Errorf("Peer %s: %v", peer.Name, err)
+		}
+
+		if peer.Retries != nil {
+			if err := peer.Retries.validate(); err != nil {
+				return nil, fmt.Errorf("Peer %s: %v", peer.Name, err)
+			}
+		}
+
+		if peer.Congestion != nil {
+			if err := peer.Congestion.validate(); err != nil {
+				return nil, fmt.Errorf("Peer %s: %v", peer.Name, err)
+			}
+		}
+
+		set.byName[peer.Name] = &peer
+		set.byAddr[peer.Address] = &peer
+	}
+
+	return set, nil
+}
+
+// checkMapsVersions is a function that checks the maps versions pinned for
+// peers are all among the given generations of the maps.
+func (set *peerSet) checkMapsVersions(gens *mapGenerations) error {
+	for _, peer := range set.byName {
+		if len(peer.MapsVersion) > 0 && gens.byVersion(peer.MapsVersion) == nil {
+			return fmt.Errorf("Peer %s: maps version %s isn't loaded", peer.Name, peer.MapsVersion)
+		}
+	}
+
+	return nil
+}
+
+// setUpKeys is a function that puts the proxy's static key, if set, in its key
+// store.
+func (p *Proxy) setUpKeys() error {
+	if len(p.opts.StaticKey) > 0 {
+		// Deriving the public key from the private one is what generating a
+		// key pair does with the random bytes it reads.
+		key, err := noise.DH25519.GenerateKeypair(bytes.NewReader(p.opts.StaticKey))
+		if err != nil {
+			return err
+		}
+
+		if err = p.keyStore.SetLocalKey(key); err != nil {
+			return err
+		}
+
+		log.Printf("Using static public key %s", hex.EncodeToString(key.Public))
+	}
+
+	return nil
+}
+
+// byTarget is a function that returns the configuration of the peer with the
+// given address, or nil if there's none.
+func (set *peerSet) byTarget(target string) *PeerOptions {
+	return set.byAddr[target]
+}
+
+// byHost is a function that returns the configuration of the peer whose
+// address has the given host, or nil if there's none or if several peers have
+// it. Other proxies send their requests from another port than the one they
+// listen on, so they can only be told apart by host.
+func (set *peerSet) byHost(host string) *PeerOptions {
+	var found *PeerOptions
+	for addr, peer := range set.byAddr {
+		if h, _, err := net.SplitHostPort(addr); err == nil && h == host {
+			if found != nil {
+				return nil
+			}
+			found = peer
+		}
+	}
+
+	return found
+}
+
+// connSettings is a struct that holds the settings of a connection to another
+// proxy, i.e. the proxy's ones overridden by the peer's configuration if any.
+type connSettings struct {
+	encryption     bool
+	blockSize      int
+	szx            coap.BlockWiseSzx
+	maxMessageSize int
+	retries        RetryOptions
+	congestion     CongestionOptions
+}
+
+// connSettingsFor is a function that returns the settings of the connections
+// to the given peer, which is nil for proxies without a specific
+// configuration.
+func (p *Proxy) connSettingsFor(peer *PeerOptions) connSettings {
+	s := connSettings{
+		encryption:     !p.opts.DisableEncryption,
+		maxMessageSize: p.opts.MaxMessageSize,
+		retries:        p.opts.Retries,
+		congestion:     p.opts.Congestion,
+	}
+	s.blockSize = p.opts.BlockSize
+
+	if peer != nil {
+		if peer.Encryption != nil {
+			s.encryption = *peer.Encryption
+		}
+		if peer.BlockSize != 0 {
+			s.blockSize = peer.BlockSize
+		}
+		if peer.MaxMessageSize != 0 {
+			s.maxMessageSize = peer.MaxMessageSize
+		}
+		if peer.Retries != nil {
+			s.retries = *peer.Retries
+		}
+		if peer.Congestion != nil {
+			s.congestion = *peer.Congestion
+		}
+	}
+
+	if s.blockSize == 0 {
+		s.blockSize = 1024
+	}
+
+	// The block sizes have been validated when creating the proxy.
+	s.szx, _ = blockSizeSzx(s.blockSize)
+
+	return s
+}
+
+// checkMaxMessageSize is a function that checks the given max message size,
+// in bytes, can hold at least a block of the given size.
+func checkMaxMessageSize(size, blockSize int) error {
+	if size < 0 {
+		return fmt.Errorf("Invalid max message size %d", size)
+	}
+
+	if blockSize == 0 {
+		blockSize = 1024
+	}
+
+	if size > 0 && size < blockSize {
+		return fmt.Errorf("Max message size %d is lower than the block size %d", size, blockSize)
+	}
+
+	return nil
+}
+
+// coapMaxMessageSize is a function that converts a max message size into the
+// value to give go-coap, which doesn't have a way to disable the limit.
+func coapMaxMessageSize(size int) uint32 {
+	if size == 0 {
+		return ^uint32(0)
+	}
+
+	return uint32(size)
+}
+
+// blockSizeSzx is a function that converts a block size in bytes into the
+// go-coap value representing it. 0 means 1024 bytes.
+func blockSizeSzx(size int) (coap.BlockWiseSzx, error) {
+	switch size {
+	case 16:
+		return coap.BlockWiseSzx16, nil
+	case 32:
+		return coap.BlockWiseSzx32, nil
+	case 64:
+		return coap.BlockWiseSzx64, nil
+	case 128:
+		return coap.BlockWiseSzx128, nil
+	case 256:
+		return coap.BlockWiseSzx256, nil
+	case 512:
+		return coap.BlockWiseSzx512, nil
+	case 0, 1024:
+		return coap.BlockWiseSzx1024, nil
+	default:
+		return 0, fmt.Errorf("Invalid block size %d, must be a power of 2 between 16 and 1024", size)
+	}
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+
+	"github.com/matrix-org/coap-proxy/common"
+)
+
+// connPool is a struct that holds the open connections to other proxies, with
+// their CoAP target (address and port) as the key. It is safe for concurrent
+// use: requests to different targets never wait on each other, and concurrent
+// requests to a target with no usable connection share a single dial.
+type connPool struct {
+	mut     sync.Mutex
+	entries map[string]*poolEntry
+	// dial opens a new connection to the given target.
+	dial func(target string) (*openConn, error)
+}
+
+// poolEntry is a struct that holds the connection to a single target, if any,
+// along with the dial in progress to it, if any.
+type poolEntry struct {
+	mut     sync.Mutex
+	conn    *openConn
+	dialing *dialCall
+}
+
+// dialCall is a struct that represents a dial in progress. done is closed once
+// it's over, after which err is set.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// newConnPool returns a new instance of the connPool struct, which opens new
+// connections with the given function.
+func newConnPool(dial func(target string) (*openConn, error)) *connPool {
+	return &connPool{
+		entries: make(map[string]*poolEntry),
+		dial:    dial,
+	}
+}
+
+// entry is a function that returns the entry for the given target, creating
+// it if needed.
+func (p *connPool) entry(target string) *poolEntry {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	e, exists := p.entries[target]
+	if !exists {
+		e = new(poolEntry)
+		p.entries[target] = e
+	}
+
+	return e
+}
+
+// get is a function that returns a usable connection to the given target,
+// opening a new one if needed. The connection must be released once done with.
+func (p *connPool) get(target string) (*openConn, error) {
+	return p.entry(target).get(target, nil, p.dial)
+}
+
+// reset is a function that drops the given connection to the given target,
+// e.g. because an exchange on it failed, and returns a usable one, opening a
+// new one if needed. If the connection has already been replaced (e.g. because
+// another request also failed on it), the replacement is returned instead of
+// opening yet another connection. The returned connection must be released
+// once done with.
+func (p *connPool) reset(target string, failed *openConn) (*openConn, error) {
+	return p.entry(target).get(target, failed, p.dial)
+}
+
+// evict is a function that removes the given connection to the given target
+// from the pool if it's still there, and closes it once the exchanges happening
+// on it are over, e.g. because it's been idle for too long.
+func (p *connPool) evict(target string, c *openConn) {
+	e := p.entry(target)
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	// If the connection has already been replaced, it's already being retired.
+	if e.conn == c {
+		e.conn = nil
+		go c.retire()
+	}
+}
+
+// redial is a function that replaces the given failed connection to the given
+// target with a new one, unless that has already been done, without waiting
+// for a request to need it.
+func (p *connPool) redial(target string, failed *openConn) {
+	c, err := p.reset(target, failed)
+	if err != nil {
+		log.Printf("WARNING: Failed to reconnect to %s: %v", target, err)
+		return
+	}
+
+	c.release()
+}
+
+// closeAll is a function that closes every connection in the pool.
+func (p *connPool) closeAll() error {
+	p.mut.Lock()
+	entries := make([]*poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	p.mut.Unlock()
+
+	for _, e := range entries {
+		e.mut.Lock()
+		c := e.conn
+		e.conn = nil
+		e.mut.Unlock()
+
+		if c != nil {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// get is a function that returns the entry's connection if it's usable and
+// isn't the given failed one, or dials a new one with the given function
+// otherwise. Only one dial happens at a time, and requests arriving while it's
+// in progress wait for it. The returned connection must be released once done
+// with.
+func (e *poolEntry) get(
+	target string, failed *openConn, dial func(target string) (*openConn, error),
+) (*openConn, error) {
+	e.mut.Lock()
+
+	for {
+		if c := e.conn; c != nil {
+			switch {
+			case c == failed:
+				common.Debugf("Dropping failed connection to %s", target)
+			case c.gens != c.proxy.loadedMaps():
+				// The maps have been reloaded since we negotiated them with
+				// the remote proxy, so we need a new connection to negotiate
+				// them again.
+				common.Debugf("Maps changed since connecting to %s", target)
+			case c.isDead():
+				common.Debugf("Connection to %s is dead", target)
+			default:
+				// Acquire the connection while holding the lock so it can't
+				// get retired in the meantime.
+				c.inFlight.Add(1)
+				e.mut.Unlock()
+				common.Debugf("Reusing existing connection to %s", target)
+				return c, nil
+			}
+
+			e.conn = nil
+			go c.retire()
+		}
+
+		d := e.dialing
+		if d == nil {
+			break
+		}
+
+		e.mut.Unlock()
+		common.Debugf("Waiting for the connection being opened to %s", target)
+		<-d.done
+
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		// Go through the checks again, as the new connection may already have
+		// been replaced.
+		e.mut.Lock()
+	}
+
+	d := &dialCall{done: make(chan struct{})}
+	e.dialing = d
+	e.mut.Unlock()
+
+	common.Debugf("No usable connection to %s, initiating a new one", target)
+	c, err := dial(target)
+
+	e.mut.Lock()
+	e.dialing = nil
+	if err == nil {
+		e.conn = c
+		c.inFlight.Add(1)
+	}
+	d.err = err
+	e.mut.Unlock()
+
+	close(d.done)
+
+	return c, err
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// testPool is a struct that holds a connPool opening connections which don't
+// talk to any proxy, and counts the dials it does.
+type testPool struct {
+	*connPool
+	p     *Proxy
+	dials int32
+
+	mut     sync.Mutex
+	dialErr error // dialErr is the error dials fail with, if any
+}
+
+// newTestPool is a function that returns a new instance of the testPool
+// struct.
+func newTestPool(t *testing.T) *testPool {
+	tp := &testPool{p: new(Proxy)}
+	tp.p.currentMaps.Store(new(mapGenerations))
+
+	tp.connPool = newConnPool(func(target string) (*openConn, error) {
+		atomic.AddInt32(&tp.dials, 1)
+		// Give the requests arriving meanwhile the time to wait on the dial.
+		time.Sleep(10 * time.Millisecond)
+
+		tp.mut.Lock()
+		err := tp.dialErr
+		tp.mut.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newTestConn(t, tp.p, target)
+	})
+
+	return tp
+}
+
+// newTestConn is a function that returns a connection to the given target
+// which isn't negotiated, and has no heartbeat.
+func newTestConn(t *testing.T, p *Proxy, target string) (*openConn, error) {
+	cc, err := coap.Dial("udp", target)
+	if err != nil {
+		t.Errorf("Failed to dial %s: %v", target, err)
+		return nil, err
+	}
+
+	return &openConn{
+		ClientConn: cc,
+		proxy:      p,
+		target:     target,
+		retries:    coap.NewRetriesQueue(time.Second, 2),
+		killswitch: make(chan struct{}),
+		gens:       p.loadedMaps(),
+	}, nil
+}
+
+// failDials is a function that makes the pool's dials fail with the given
+// error, or succeed again if it's nil.
+func (tp *testPool) failDials(err error) {
+	tp.mut.Lock()
+	defer tp.mut.Unlock()
+
+	tp.dialErr = err
+}
+
+// dialCount is a function that returns how many dials the pool did.
+func (tp *testPool) dialCount() int {
+	return int(atomic.LoadInt32(&tp.dials))
+}
+
+// getConcurrently is a function that gets a connection to the given target
+// from n goroutines at once, and returns the connections they got.
+func getConcurrently(t *testing.T, get func() (*openConn, error), n int) []*openConn {
+	conns := make([]*openConn, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c, err := get()
+			if err != nil {
+				t.Errorf("Failed to get a connection: %v", err)
+				return
+			}
+			conns[i] = c
+		}(i)
+	}
+	wg.Wait()
+
+	return conns
+}
+
+// isClosed is a function that returns whether the given connection gets
+// closed within a second.
+func isClosed(c *openConn) bool {
+	select {
+	case <-c.killswitch:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// isOpen is a function that returns whether the given connection is still
+// open after a little while.
+func isOpen(c *openConn) bool {
+	select {
+	case <-c.killswitch:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestConnPoolGetSharesDial(t *testing.T) {
+	tp := newTestPool(t)
+	defer tp.closeAll()
+
+	target := "127.0.0.1:15683"
+	conns := getConcurrently(t, func() (*openConn, error) { return tp.get(target) }, 50)
+
+	if n := tp.dialCount(); n != 1 {
+		t.Fatalf("Expected 1 dial, got %d", n)
+	}
+	for _, c := range conns {
+		if c != conns[0] {
+			t.Fatal("Concurrent requests got different connections")
+		}
+		c.release()
+	}
+
+	// Other targets get their own connection.
+	other, err := tp.get("127.0.0.1:15684")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.release()
+
+	if other == conns[0] || tp.dialCount() != 2 {
+		t.Fatal("Expected another target to get a new connection")
+	}
+}
+
+func TestConnPoolGetDialError(t *testing.T) {
+	tp := newTestPool(t)
+	defer tp.closeAll()
+
+	dialErr := errors.New("unreachable")
+	tp.failDials(dialErr)
+
+	target := "127.0.0.1:15683"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := tp.get(target); err != dialErr {
+				t.Errorf("Expected the dial's error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A failed dial isn't remembered, so the next request tries again.
+	tp.failDials(nil)
+	dials := tp.dialCount()
+
+	c, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release()
+
+	if tp.dialCount() != dials+1 {
+		t.Fatal("Expected a new dial after a failed one")
+	}
+}
+
+func TestConnPoolReset(t *testing.T) {
+	tp := newTestPool(t)
+	defer tp.closeAll()
+
+	target := "127.0.0.1:15683"
+
+	failed, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request which failed on the connection resets it, but only one
+	// replacement gets opened.
+	conns := getConcurrently(t, func() (*openConn, error) { return tp.reset(target, failed) }, 20)
+
+	if n := tp.dialCount(); n != 2 {
+		t.Fatalf("Expected 2 dials, got %d", n)
+	}
+	for _, c := range conns {
+		if c == failed || c != conns[0] {
+			t.Fatal("Expected a single replacement connection")
+		}
+	}
+
+	// The failed connection is only closed once its exchange is over.
+	if !isOpen(failed) {
+		t.Fatal("Failed connection was closed while still in use")
+	}
+	failed.release()
+	if !isClosed(failed) {
+		t.Fatal("Failed connection wasn't closed")
+	}
+
+	for _, c := range conns {
+		c.release()
+	}
+}
+
+func TestConnPoolEvict(t *testing.T) {
+	tp := newTestPool(t)
+	defer tp.closeAll()
+
+	target := "127.0.0.1:15683"
+
+	c, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Evicting concurrently with requests doesn't hand out the evicted
+	// connection once it's gone from the pool.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			tp.evict(target, c)
+		}()
+		go func() {
+			defer wg.Done()
+
+			got, err := tp.get(target)
+			if err != nil {
+				t.Errorf("Failed to get a connection: %v", err)
+				return
+			}
+			got.release()
+		}()
+	}
+	wg.Wait()
+
+	if !isOpen(c) {
+		t.Fatal("Evicted connection was closed while still in use")
+	}
+	c.release()
+	if !isClosed(c) {
+		t.Fatal("Evicted connection wasn't closed")
+	}
+
+	next, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.release()
+
+	if next == c {
+		t.Fatal("Got the evicted connection back")
+	}
+}
+
+func TestConnPoolMapsReloaded(t *testing.T) {
+	tp := newTestPool(t)
+	defer tp.closeAll()
+
+	target := "127.0.0.1:15683"
+
+	old, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.release()
+
+	tp.p.currentMaps.Store(new(mapGenerations))
+
+	c, err := tp.get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release()
+
+	if c == old || !isClosed(old) {
+		t.Fatal("Expected the connection to be replaced after the maps changed")
+	}
+}
+
+func TestConnPoolCloseAll(t *testing.T) {
+	tp := newTestPool(t)
+
+	targets := []string{"127.0.0.1:15683", "127.0.0.1:15684", "127.0.0.1:15685"}
+
+	var (
+		mut   sync.Mutex
+		conns []*openConn
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			c, err := tp.get(target)
+			if err != nil {
+				t.Errorf("Failed to get a connection: %v", err)
+				return
+			}
+			c.release()
+
+			mut.Lock()
+			conns = append(conns, c)
+			mut.Unlock()
+		}(targets[i%len(targets)])
+	}
+	wg.Wait()
+
+	if err := tp.closeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := tp.dialCount(); n != len(targets) {
+		t.Fatalf("Expected %d dials, got %d", len(targets), n)
+	}
+	for _, c := range conns {
+		if !isClosed(c) {
+			t.Fatalf("Connection to %s wasn't closed", c.target)
+		}
+	}
+
+	// The pool can still be used after closing its connections.
+	c, err := tp.get(targets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release()
+
+	if tp.dialCount() != len(targets)+1 || !isOpen(c) {
+		t.Fatal("Expected a new connection after closing the pool's")
+	}
+
+	if err = tp.closeAll(); err != nil {
+		t.Fatal(err)
+	}
+}
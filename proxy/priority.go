@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// priority is the traffic class of a request, which decides the order in
+// which the requests waiting to be sent to the same proxy are sent. Lower
+// values are sent first.
+type priority int
+
+const (
+	// priorityHigh is the class of the requests a user is waiting on, e.g.
+	// sending a message or a federation transaction.
+	priorityHigh priority = iota
+	// priorityNormal is the class of the requests which don't have a priority
+	// in the maps.
+	priorityNormal
+	// priorityLow is the class of background fetches, e.g. syncing or
+	// downloading media.
+	priorityLow
+)
+
+// priorityNames maps the priorities to their name in routes.json.
+var priorityNames = map[priority]string{
+	priorityHigh:   "high",
+	priorityNormal: "normal",
+	priorityLow:    "low",
+}
+
+// parsePriority is a function that returns the priority with the given name in
+// routes.json. A route without a priority has the normal one.
+func parsePriority(name string) (priority, error) {
+	if len(name) == 0 {
+		return priorityNormal, nil
+	}
+
+	for prio, n := range priorityNames {
+		if n == name {
+			return prio, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown priority %q", name)
+}
+
+// String is a function that returns the name of the priority in routes.json.
+func (prio priority) String() string {
+	return priorityNames[prio]
+}
+
+// priority is a function that returns the priority of the route. The maps'
+// priorities are checked when they're loaded.
+func (r route) priority() priority {
+	prio, _ := parsePriority(r.Priority)
+	return prio
+}
+
+// rank is a function that returns the priority the waiter has at the given
+// time, which goes up by one every aging it has waited so lower priorities
+// don't starve. It can go higher than priorityHigh so the oldest waiters
+// keep precedence. An aging of 0 disables it.
+func (w *linkWaiter) rank(now time.Time, aging time.Duration) int {
+	rank := int(w.prio)
+	if aging > 0 {
+		rank -= int(now.Sub(w.queued) / aging)
+	}
+
+	return rank
+}
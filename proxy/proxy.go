@@ -0,0 +1,551 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package proxy implements a proxy which translates Matrix HTTP requests into
+// compressed CoAP requests to another instance of the proxy, which translates
+// them back into HTTP requests to its homeserver.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/types"
+
+	"github.com/matrix-org/go-coap"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	fedAuthPrefix = "X-Matrix origin="
+	fedAuthSuffix = ",key=\"\",sig=\"\""
+
+	routePatternRgxp = regexp.MustCompile("{[^/]+}")
+	fedAuthRgxp      = regexp.MustCompile(fedAuthPrefix + "([^,]+)")
+
+	// CBOR encoder/decoder
+	cbor = new(types.CBOR)
+
+	// JSON encoder/decoder
+	json = new(types.JSON)
+)
+
+// Options is a struct that holds the configuration of a Proxy.
+type Options struct {
+	// CoAPAddr is the host+port to listen for CoAP requests from other
+	// proxies on. Start doesn't listen for CoAP requests if it's empty.
+	CoAPAddr string
+	// HTTPAddr is the host+port to listen for HTTP requests to proxy to other
+	// proxies on. Start doesn't listen for HTTP requests if it's empty.
+	HTTPAddr string
+	// AdminAddr is the host+port to serve the admin endpoints on. Start doesn't
+	// serve them if it's empty.
+	AdminAddr string
+	// CoAPPort is the port other proxies listen for CoAP requests on.
+	CoAPPort string
+	// CoAPTarget forces the host+port of the proxy to send every CoAP request
+	// to, instead of the host of the HTTP request on CoAPPort.
+	CoAPTarget string
+	// HTTPTarget is the base URL of the homeserver to send HTTP requests to.
+	HTTPTarget string
+	// DisableEncryption disables noise encryption.
+	DisableEncryption bool
+	// StaticKey is the proxy's noise static private key. A new one is
+	// generated on startup if it's empty.
+	StaticKey []byte
+	// MapsDir is the directory in which the JSON maps live.
+	MapsDir string
+	// PreviousMapsDirs are the directories in which previous generations of
+	// the JSON maps live, from the newest to the oldest.
+	PreviousMapsDirs []string
+	// MapsMismatch is what to do when talking to a proxy with different maps,
+	// either MapsMismatchFallback or MapsMismatchRefuse.
+	MapsMismatch string
+	// Compression is the algorithm to compress payloads with the maps'
+	// dictionary with, either types.BackendFlate or types.BackendZstd.
+	Compression string
+	// DropErrorMessages drops the human-readable message of Matrix errors sent
+	// back over CoAP.
+	DropErrorMessages bool
+	// HeartbeatInterval is how long a connection to another proxy can go
+	// without receiving anything before it gets pinged, 0 to disable
+	// heartbeats.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long to wait for the answer to a ping before
+	// considering the connection dead.
+	HeartbeatTimeout time.Duration
+	// IdleTimeout is how long a connection to another proxy can go unused
+	// before it gets closed, 0 to keep connections open forever.
+	IdleTimeout time.Duration
+	// Retries is how to retransmit the CoAP messages which haven't been
+	// acknowledged.
+	Retries RetryOptions
+	// BlockSize is the size in bytes of the blocks of block-wise transfers:
+	// 16, 32, 64, 128, 256, 512 or 1024. 0 means 1024.
+	BlockSize int
+	// MaxMessageSize is the largest payload, once reassembled from its
+	// blocks, to accept from another proxy, 0 for no limit. It can't be lower
+	// than the block size.
+	MaxMessageSize int
+	// Congestion is how to limit the traffic sent to other proxies.
+	Congestion CongestionOptions
+	// Peers is the configuration specific to some other proxies.
+	Peers []PeerOptions
+	// Tracing sends the context of the current trace along with requests to
+	// other proxies.
+	Tracing bool
+	// ObserveSync observes clients' syncs with the other proxies instead of
+	// long-polling them over CoAP, and lets other proxies observe them.
+	ObserveSync bool
+	// CacheSize is how many bytes of responses to GET requests on routes with
+	// a max age in the maps to keep, 0 to disable caching them.
+	CacheSize int
+	// StoreForward is how to queue the requests to other proxies which can't
+	// be reached.
+	StoreForward StoreForwardOptions
+	// BatchWindow is how long to wait for more federation transactions to the
+	// same proxy before sending them together, 0 to send each one on its own.
+	BatchWindow time.Duration
+	// MaxBatch is the largest number of federation transactions to send
+	// together.
+	MaxBatch int
+}
+
+// DefaultOptions is a function that returns the default configuration of a
+// Proxy, which is also the CLI's.
+func DefaultOptions() Options {
+	return Options{
+		CoAPAddr:          "0.0.0.0:5683",
+		HTTPAddr:          "0.0.0.0:8888",
+		CoAPPort:          "5683",
+		HTTPTarget:        "http://127.0.0.1:8008",
+		MapsDir:           "maps",
+		MapsMismatch:      MapsMismatchFallback,
+		Compression:       types.BackendFlate,
+		HeartbeatInterval: 30 * time.Second,
+		HeartbeatTimeout:  10 * time.Second,
+		IdleTimeout:       3 * time.Minute,
+		Retries: RetryOptions{
+			// 40 seconds as an initial delay should be enough to prevent sync
+			// responses from being sent twice (since Riot's timeout for syncs
+			// is 30s).
+			InitialBackoff: 40 * time.Second,
+			Multiplier:     1,
+			MinBackoff:     time.Second,
+		},
+		BlockSize: 1024,
+		Congestion: CongestionOptions{
+			MaxQueue:      64,
+			PriorityAging: 30 * time.Second,
+		},
+		CacheSize: 4 << 20,
+		StoreForward: StoreForwardOptions{
+			Routes:        []string{"PUT /_matrix/federation/v1/send/{txnId}"},
+			Status:        http.StatusAccepted,
+			RetryInterval: 30 * time.Second,
+			MaxQueue:      1000,
+		},
+		MaxBatch: 10,
+	}
+}
+
+// Proxy is a struct that represents an instance of the proxy. It proxies the
+// HTTP requests it serves to other proxies over CoAP, and the CoAP requests it
+// serves to its homeserver over HTTP.
+type Proxy struct {
+	opts Options
+
+	// currentMaps holds the *mapGenerations currently in use. Request handlers
+	// must only load it once so they use the same maps from start to finish
+	// even if they get reloaded in the meantime.
+	currentMaps atomic.Value
+	// reloadMut prevents concurrent reloads of the maps.
+	reloadMut sync.Mutex
+
+	// Compression hook for the CoAP server, which compresses responses the
+	// same way as the requests they answer
+	serverTransport *types.Transport
+	// In-memory store for crypto keys which implements the go-coap.KeyStore
+	// interface.
+	keyStore *types.InMemoryKeyStore
+	// Instance of go-coap.RetriesQueue we'll give to our server so it can
+	// handle retries. Connections to other proxies each have their own, so
+	// their retransmissions can be cancelled when they're given up on.
+	retriesQueue *coap.RetriesQueue
+
+	// Configuration specific to some other proxies
+	peers *peerSet
+	// Pool of open connections to other proxies
+	conns *connPool
+	// Round-trip time estimates of the other proxies
+	rtts *rttTracker
+	// Congestion control of the traffic sent to the other proxies
+	links *linkSet
+	// Tracker of the requests being served, for draining them on shutdown
+	requests *requestTracker
+	// Syncs observed with other proxies, and by other proxies
+	observations *observationSet
+	observers    *observerSet
+	// Responses from other proxies to GET requests, nil if disabled
+	cache *responseCache
+	// Requests queued until the other proxies can be reached, nil if disabled
+	forwarding *storeForward
+	// Federation transactions waiting to be sent together, nil if disabled
+	batching *batcher
+
+	coapServer  *coap.Server
+	coapConn    *net.UDPConn
+	httpServer  *http.Server
+	adminServer *http.Server
+	// serving is done once every server started by Start has exited.
+	serving sync.WaitGroup
+}
+
+// Validate is a function that checks the options are valid, and that the maps
+// they point to load, without setting anything up: it doesn't create the
+// store-and-forward directory or resolve any host.
+func (opts Options) Validate() error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	peers, err := newPeerSet(opts)
+	if err != nil {
+		return err
+	}
+
+	gens, err := loadGenerations(opts.mapsDirs(), opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	return peers.checkMapsVersions(gens)
+}
+
+// validate is a function that checks the options are valid, apart from the
+// maps they point to.
+func (opts Options) validate() error {
+	if opts.MapsMismatch != MapsMismatchFallback && opts.MapsMismatch != MapsMismatchRefuse {
+		return fmt.Errorf("Invalid maps mismatch policy: %s", opts.MapsMismatch)
+	}
+
+	if opts.Compression != types.BackendFlate && opts.Compression != types.BackendZstd {
+		return fmt.Errorf("Invalid compression backend: %s", opts.Compression)
+	}
+
+	if opts.HeartbeatInterval < 0 || opts.IdleTimeout < 0 {
+		return errors.New("Heartbeat interval and idle timeout can't be negative")
+	}
+
+	if opts.HeartbeatInterval > 0 && opts.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("Invalid heartbeat timeout: %v", opts.HeartbeatTimeout)
+	}
+
+	if err := opts.Retries.validate(); err != nil {
+		return err
+	}
+
+	if err := opts.Congestion.validate(); err != nil {
+		return err
+	}
+
+	if opts.CacheSize < 0 {
+		return fmt.Errorf("Invalid cache size: %d", opts.CacheSize)
+	}
+
+	if opts.BatchWindow < 0 || (opts.BatchWindow > 0 && opts.MaxBatch < 1) {
+		return fmt.Errorf("Invalid batch window (%v) or maximum batch size (%d)", opts.BatchWindow, opts.MaxBatch)
+	}
+
+	if _, err := blockSizeSzx(opts.BlockSize); err != nil {
+		return err
+	}
+
+	if err := checkMaxMessageSize(opts.MaxMessageSize, opts.BlockSize); err != nil {
+		return err
+	}
+
+	if len(opts.StaticKey) > 0 && len(opts.StaticKey) != staticKeyLen {
+		return fmt.Errorf("Static key must be %d bytes long", staticKeyLen)
+	}
+
+	if len(opts.StoreForward.Dir) > 0 {
+		return opts.StoreForward.validate()
+	}
+
+	return nil
+}
+
+// New is a function that returns a new Proxy with the given configuration,
+// after loading its maps.
+func New(opts Options) (*Proxy, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	peers, err := newPeerSet(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		opts:         opts,
+		keyStore:     types.NewKeyStore(),
+		retriesQueue: opts.Retries.newQueue(),
+		peers:        peers,
+		requests:     newRequestTracker(),
+		rtts:         newRTTTracker(),
+		links:        newLinkSet(),
+		observations: newObservationSet(),
+		observers:    newObserverSet(),
+		cache:        newResponseCache(opts.CacheSize),
+	}
+	p.conns = newConnPool(p.newOpenConn)
+	p.batching = newBatcher(p)
+
+	if p.forwarding, err = newStoreForward(p, opts.StoreForward); err != nil {
+		return nil, err
+	}
+
+	if err = p.setUpKeys(); err != nil {
+		return nil, err
+	}
+
+	if opts.DisableEncryption {
+		log.Printf("Encryption disabled")
+	} else {
+		log.Printf("Encryption enabled")
+	}
+
+	log.Printf("Compressing payloads with %s", opts.Compression)
+
+	// Parse maps for later compression purposes. These allow for compression
+	// something like a known Matrix API endpoint route down into a single integer.
+	gens, err := loadGenerations(opts.mapsDirs(), opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = peers.checkMapsVersions(gens); err != nil {
+		return nil, err
+	}
+
+	p.currentMaps.Store(gens)
+	p.serverTransport = types.NewTransport(gens.compressors(), gens.newest().compressor.Tag())
+
+	log.Printf("Finished loading compression maps (versions %s)", strings.Join(gens.versions(), ", "))
+	gens.warnNoServerNames()
+
+	return p, nil
+}
+
+// Start is a function that starts listening for CoAP requests, HTTP requests
+// and admin requests, on the addresses set in the proxy's options, and serves
+// them in the background until Shutdown is called. It returns an error if any
+// of the addresses can't be listened on, in which case none is.
+func (p *Proxy) Start() (err error) {
+	var httpListener, adminListener net.Listener
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, l := range []net.Listener{httpListener, adminListener} {
+			if l != nil {
+				_ = l.Close()
+			}
+		}
+
+		if p.coapConn != nil {
+			_ = p.coapConn.Close()
+			p.coapConn = nil
+		}
+	}()
+
+	// Listens for CoAP requests and sends out HTTP
+	if len(p.opts.CoAPAddr) > 0 {
+		if p.coapConn, err = listenUDP(p.opts.CoAPAddr); err != nil {
+			return
+		}
+	}
+
+	// Listens for HTTP requests and sends out CoAP
+	if len(p.opts.HTTPAddr) > 0 {
+		if httpListener, err = net.Listen("tcp", p.opts.HTTPAddr); err != nil {
+			return
+		}
+	}
+
+	if len(p.opts.AdminAddr) > 0 {
+		if adminListener, err = net.Listen("tcp", p.opts.AdminAddr); err != nil {
+			return
+		}
+	}
+
+	if p.coapConn != nil {
+		p.coapServer = p.newCoAPServer(coapRecoverWrap(coap.HandlerFunc(p.ServeCOAP)))
+		p.coapServer.Conn = p.coapConn
+
+		p.serving.Add(1)
+		go func() {
+			defer p.serving.Done()
+			log.Printf("Setting up CoAP to HTTP proxy on %s", p.coapConn.LocalAddr())
+			log.Println(p.coapServer.ActivateAndServe())
+			log.Println("CoAP to HTTP proxy exited")
+		}()
+	}
+
+	if httpListener != nil {
+		p.httpServer = &http.Server{Handler: httpRecoverWrap(p)}
+
+		p.serving.Add(1)
+		go func() {
+			defer p.serving.Done()
+			log.Printf("Setting up HTTP to CoAP proxy on %s", httpListener.Addr())
+			log.Println(p.httpServer.Serve(httpListener))
+			log.Println("HTTP to CoAP proxy exited")
+		}()
+	}
+
+	if p.forwarding != nil {
+		p.forwarding.resume()
+	}
+
+	if adminListener != nil {
+		p.adminServer = &http.Server{Handler: httpRecoverWrap(p.adminMux())}
+
+		p.serving.Add(1)
+		go func() {
+			defer p.serving.Done()
+			log.Printf("Setting up admin endpoints on %s", adminListener.Addr())
+			log.Println(p.adminServer.Serve(adminListener))
+			log.Println("Admin endpoints exited")
+		}()
+	}
+
+	return nil
+}
+
+// ServeHTTP is a function that implements http.Handler, proxying HTTP requests
+// to other proxies over CoAP. Requests it's given once Shutdown has been called
+// are answered with a 503.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.requests.begin() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.requests.end()
+
+	p.serveHTTP(w, r)
+}
+
+// ServeCOAP is a function that implements coap.Handler, proxying CoAP requests
+// from other proxies to the homeserver over HTTP. Requests it's given once
+// Shutdown has been called are answered with a ServiceUnavailable.
+func (p *Proxy) ServeCOAP(w coap.ResponseWriter, req *coap.Request) {
+	if !p.requests.begin() {
+		w.SetCode(coap.ServiceUnavailable)
+		_, _ = w.Write(nil)
+		return
+	}
+	defer p.requests.end()
+
+	p.serveCOAP(w, req)
+}
+
+// listenUDP is a function that opens a UDP socket listening on the given
+// address, set up the same way go-coap's servers set theirs up.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-coap needs to know which address each message was sent to.
+	if ip4 := conn.LocalAddr().(*net.UDPAddr).IP.To4(); ip4 != nil {
+		err = ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	} else {
+		err = ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func httpRecoverWrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer func() {
+			r := recover()
+			if r != nil {
+				switch t := r.(type) {
+				case string:
+					err = errors.New(t)
+				case error:
+					err = t
+				default:
+					err = errors.New("Unknown error")
+				}
+				log.Printf("Recovered from panic: %v", err)
+				log.Println("Stacktrace:\n" + string(debug.Stack()))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func coapRecoverWrap(h coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		var err error
+		defer func() {
+			r := recover()
+			if r != nil {
+				switch t := r.(type) {
+				case string:
+					err = errors.New(t)
+				case error:
+					err = t
+				default:
+					err = errors.New("Unknown error")
+				}
+				log.Printf("Recovered from panic: %v", err)
+				log.Println("Stacktrace:\n" + string(debug.Stack()))
+			}
+		}()
+		h.ServeCOAP(w, r)
+	})
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/matrix-org/go-coap"
+)
+
+// RetryOptions is a struct that holds how to retransmit CoAP messages which
+// haven't been acknowledged.
+//
+// go-coap waits InitialBackoff before the first retransmission, then
+// multiplies the backoff by Multiplier after every retransmission. It can't
+// cap the backoff, so MaxBackoff is checked against the whole schedule
+// instead.
+type RetryOptions struct {
+	// Count is how many times to retransmit a message before giving up on
+	// the exchange, 0 to keep retransmitting it until the exchange times out
+	// (after 5 minutes).
+	Count int
+	// InitialBackoff is how long to wait for an acknowledgement before
+	// retransmitting a message for the first time.
+	InitialBackoff time.Duration
+	// Multiplier is what to multiply the backoff by after each
+	// retransmission, 1 to retransmit at a fixed interval.
+	Multiplier int
+	// MaxBackoff is the longest the backoff can get, 0 for no limit. It can't
+	// be lower than any of the backoffs of the schedule.
+	MaxBackoff time.Duration
+	// Adaptive derives the initial backoff of new connections from the
+	// round-trip times measured to the peer, InitialBackoff only being used
+	// until the first measurements. See rttEstimator.
+	Adaptive bool
+	// MinBackoff is the shortest the initial backoff can get when it's
+	// adaptive.
+	MinBackoff time.Duration
+}
+
+// maxAdaptiveBackoff is the longest the initial backoff can get when it's
+// adaptive and there's no max backoff, which is the lowest upper bound RFC 6298
+// allows retransmission timeouts to have.
+const maxAdaptiveBackoff = 60 * time.Second
+
+// validate is a function that checks the retry options make up a schedule
+// go-coap can follow.
+func (o RetryOptions) validate() error {
+	if o.Count < 0 {
+		return fmt.Errorf("Invalid retry count: %d", o.Count)
+	}
+
+	if o.InitialBackoff <= 0 {
+		return fmt.Errorf("Invalid initial backoff: %v", o.InitialBackoff)
+	}
+
+	if o.Multiplier < 1 {
+		return fmt.Errorf("Invalid backoff multiplier: %d", o.Multiplier)
+	}
+
+	if o.MaxBackoff != 0 && o.MaxBackoff < o.InitialBackoff {
+		return fmt.Errorf("Max backoff %v is lower than the initial backoff %v", o.MaxBackoff, o.InitialBackoff)
+	}
+
+	if o.MaxBackoff != 0 && o.Count == 0 && o.Multiplier > 1 {
+		return errors.New("The backoff can't stay under the max backoff without a retry count when it's multiplied")
+	}
+
+	if o.MinBackoff < 0 {
+		return fmt.Errorf("Invalid min backoff: %v", o.MinBackoff)
+	}
+
+	if o.Adaptive && o.MinBackoff == 0 {
+		return errors.New("The min backoff must be set when the backoff is adaptive")
+	}
+
+	if err := o.checkSchedule(o.InitialBackoff); err != nil {
+		return err
+	}
+
+	if !o.Adaptive {
+		return nil
+	}
+
+	if o.MinBackoff > o.maxInitialBackoff() {
+		return fmt.Errorf(
+			"The min backoff %v is more than the max backoff allows the initial backoff to be (%v)",
+			o.MinBackoff, o.maxInitialBackoff(),
+		)
+	}
+
+	// The schedule is the longest when the adaptive initial backoff is at its
+	// highest.
+	return o.checkSchedule(o.maxInitialBackoff())
+}
+
+// checkSchedule is a function that walks the schedule starting with the given
+// initial backoff, checking it stays under the max backoff and its duration
+// doesn't overflow.
+func (o RetryOptions) checkSchedule(initialBackoff time.Duration) error {
+	var total time.Duration
+	backoff := initialBackoff
+	for i := 0; i <= o.Count; i++ {
+		if o.MaxBackoff != 0 && backoff > o.MaxBackoff {
+			return fmt.Errorf(
+				"The backoff reaches %v after %d retransmissions, which is more than the max backoff %v",
+				backoff, i, o.MaxBackoff,
+			)
+		}
+
+		if total > math.MaxInt64-backoff {
+			return errors.New("The retry schedule is too long")
+		}
+		total += backoff
+
+		if i < o.Count {
+			if backoff > math.MaxInt64/time.Duration(o.Multiplier) {
+				return errors.New("The retry schedule is too long")
+			}
+			backoff *= time.Duration(o.Multiplier)
+		}
+	}
+
+	return nil
+}
+
+// maxInitialBackoff is a function that returns the longest the initial backoff
+// can get when it's adaptive, i.e. the longest one for which the schedule
+// stays under the max backoff, if any.
+func (o RetryOptions) maxInitialBackoff() time.Duration {
+	if o.MaxBackoff == 0 {
+		return maxAdaptiveBackoff
+	}
+
+	backoff := o.MaxBackoff
+	for i := 0; i < o.Count; i++ {
+		backoff /= time.Duration(o.Multiplier)
+	}
+
+	return backoff
+}
+
+// withInitialBackoff is a function that returns the options with the given
+// initial backoff, bounded by MinBackoff and maxInitialBackoff.
+func (o RetryOptions) withInitialBackoff(backoff time.Duration) RetryOptions {
+	if max := o.maxInitialBackoff(); backoff > max {
+		backoff = max
+	}
+	if backoff < o.MinBackoff {
+		backoff = o.MinBackoff
+	}
+
+	o.InitialBackoff = backoff
+	return o
+}
+
+// exchangeTimeout is a function that returns how long to wait for the
+// response to a request, i.e. until the backoff following the last
+// retransmission is almost over, so the exchange is given up on before
+// go-coap retransmits the request once more. It returns 0 if the retry count
+// isn't limited.
+func (o RetryOptions) exchangeTimeout() time.Duration {
+	if o.Count == 0 {
+		return 0
+	}
+
+	var timeout time.Duration
+	backoff := o.InitialBackoff
+	for i := 0; i <= o.Count; i++ {
+		timeout += backoff
+		if i < o.Count {
+			backoff *= time.Duration(o.Multiplier)
+		}
+	}
+
+	return timeout - backoff/10
+}
+
+// retransmissions is a function that returns how many times a message which
+// was acknowledged the given time after its first transmission was
+// retransmitted, following the options' schedule.
+func (o RetryOptions) retransmissions(elapsed time.Duration) int {
+	n := 0
+	backoff := o.InitialBackoff
+	for at := backoff; at <= elapsed; at += backoff {
+		n++
+		backoff *= time.Duration(o.Multiplier)
+	}
+
+	return n
+}
+
+// newQueue is a function that returns a go-coap retries queue which follows
+// the options' schedule.
+func (o RetryOptions) newQueue() *coap.RetriesQueue {
+	return coap.NewRetriesQueue(o.InitialBackoff, o.Multiplier)
+}
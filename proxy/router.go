@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// routeMatch is a struct that represents a request's path matched against a
+// route of routes.json.
+type routeMatch struct {
+	id       int      // id is the route's ID
+	patterns []string // patterns are the route's arguments' patterns, e.g. {roomId}
+	args     []string // args are the values of the arguments in the path
+}
+
+// routeNode is a struct that represents a node of a routeTrie, i.e. a path
+// segment.
+type routeNode struct {
+	// literals are the children of the node matching a given segment exactly.
+	literals map[string]*routeNode
+	// param is the child of the node matching any segment, if any routes have
+	// an argument there.
+	param *routeNode
+	// routes are the IDs of the routes whose path ends on this node, by
+	// upper-case method.
+	routes map[string]int
+}
+
+// routeTrie is a struct that matches paths against the routes of routes.json
+// in a single pass over their segments. It's built once when loading the maps.
+type routeTrie struct {
+	root     *routeNode
+	patterns [][]string // patterns are the arguments' patterns of each route
+}
+
+// newRouteNode returns a new instance of the routeNode struct.
+func newRouteNode() *routeNode {
+	return &routeNode{
+		literals: make(map[string]*routeNode),
+		routes:   make(map[string]int),
+	}
+}
+
+// newRouteTrie returns a new instance of the routeTrie struct built from the
+// given routes, which must have been validated beforehand.
+func newRouteTrie(routes []route) *routeTrie {
+	t := &routeTrie{
+		root:     newRouteNode(),
+		patterns: make([][]string, len(routes)),
+	}
+
+	for id, r := range routes {
+		node := t.root
+		patterns := make([]string, 0)
+
+		for _, seg := range strings.Split(r.Path, "/") {
+			if routePatternRgxp.MatchString(seg) {
+				if node.param == nil {
+					node.param = newRouteNode()
+				}
+				node = node.param
+				patterns = append(patterns, seg)
+				continue
+			}
+
+			child, ok := node.literals[seg]
+			if !ok {
+				child = newRouteNode()
+				node.literals[seg] = child
+			}
+			node = child
+		}
+
+		// If a route appears more than once, the first one wins.
+		method := strings.ToUpper(r.Method)
+		if _, exists := node.routes[method]; !exists {
+			node.routes[method] = id
+		}
+
+		t.patterns[id] = patterns
+	}
+
+	return t
+}
+
+// match is a function that looks for the route matching a given path and
+// method. If several routes match, the one with the lowest ID wins.
+// Found is false if no route matches.
+func (t *routeTrie) match(path, method string) (m *routeMatch, found bool) {
+	id, args, found := t.root.match(strings.Split(path, "/"), strings.ToUpper(method), nil)
+	if !found {
+		return nil, false
+	}
+
+	return &routeMatch{
+		id:       id,
+		patterns: t.patterns[id],
+		args:     args,
+	}, true
+}
+
+// match is a function that looks for the route with the lowest ID matching the
+// given remaining segments of a path from this node, and returns it along with
+// the values of the arguments found on the way, appended to the given ones.
+func (n *routeNode) match(
+	segs []string, method string, args []string,
+) (id int, foundArgs []string, found bool) {
+	if len(segs) == 0 {
+		id, found = n.routes[method]
+		return id, args, found
+	}
+
+	if child, ok := n.literals[segs[0]]; ok {
+		id, foundArgs, found = child.match(segs[1:], method, args)
+	}
+
+	if n.param != nil {
+		// Copy the arguments so the ones found through the literal child don't
+		// get overwritten.
+		paramArgs := append(append([]string(nil), args...), segs[0])
+		if paramID, a, ok := n.param.match(segs[1:], method, paramArgs); ok && (!found || paramID < id) {
+			id, foundArgs, found = paramID, a, true
+		}
+	}
+
+	return
+}
@@ -1,14 +1,15 @@
-package main
+package proxy
 
 import (
 	"errors"
 	"fmt"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/matrix-org/coap-proxy/common"
+
+	"github.com/matrix-org/go-coap"
 )
 
 const (
@@ -22,7 +23,35 @@ const (
 type route struct {
 	Path   string `json:"path"`
 	Method string `json:"method"`
-	Name   string `json:"name,allowempty"`
+	Name   string `json:"name,omitempty"`
+	// Priority is the traffic class of the route's requests: "high", "normal"
+	// (if empty) or "low".
+	Priority string `json:"priority,omitempty"`
+	// MaxAge is how many seconds the proxy sending a GET request on the route
+	// can cache the response for. 0 (if empty) means it can't cache it.
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+// decodeError is an error which occurred while decoding a request from another
+// proxy, e.g. because it refers to an entry our maps don't have. Such requests
+// are answered with code, and a Matrix error with the error's message.
+type decodeError struct {
+	code coap.COAPCode
+	msg  string
+}
+
+// Error implements error.
+func (e *decodeError) Error() string {
+	return e.msg
+}
+
+// newDecodeError is a function that returns a decodeError with the given code
+// and formatted message.
+func newDecodeError(code coap.COAPCode, format string, a ...interface{}) error {
+	return &decodeError{
+		code: code,
+		msg:  fmt.Sprintf(format, a...),
+	}
 }
 
 // argsAndRouteFromPath is a function that returns the routeID (encoded integer
@@ -31,15 +60,16 @@ type route struct {
 func argsAndRouteFromPath(
 	path string,
 ) (args []string, trailingSlash bool, routeID int, err error) {
+	if len(path) == 0 {
+		err = errors.New("Got empty path")
+		return
+	}
+
 	deconstructedPath := strings.Split(path, "/")
 
 	common.Debugf("deconstructedPath %v", deconstructedPath)
 
 	var r int64
-	if len(deconstructedPath) == 0 {
-		err = errors.New("Got empty path")
-		return
-	}
 
 	if deconstructedPath[0] == "" {
 		r, err = strconv.ParseInt(deconstructedPath[1], 32, 64)
@@ -63,26 +93,13 @@ func argsAndRouteFromPath(
 // Essentially something like /_matrix/federation/v1/send/{txnId} becomes `1`
 // The proxy then sends `1` over the wire to the other proxy, and as long as
 // they have the same mapping between paths and IDs, then the proxy on the other
-// end knows what the correct path is.
-func identifyRoute(path, method string) (routeID int, found bool) {
-	patternMatcher := "[^/]*"
-	for id, route := range routes {
-		routeRgxpBase := "^" + route.Path + "$"
-		matches := routePatternRgxp.FindAllString(routeRgxpBase, -1)
-		for _, match := range matches {
-			routeRgxpBase = strings.Replace(routeRgxpBase, match, patternMatcher, -1)
-		}
-		if regexp.MustCompile(routeRgxpBase).MatchString(path) {
-			if strings.EqualFold(method, route.Method) {
-				routeID = id
-				found = true
-				break
-			}
-		}
-	}
+// end knows what the correct path is. The returned match also holds the
+// values of the route's arguments in the path.
+func (ms *mapSet) identifyRoute(path, method string) (m *routeMatch, found bool) {
+	m, found = ms.router.match(path, method)
 
 	if found {
-		common.Debugf("Identified route #%d", routeID)
+		common.Debugf("Identified route #%d", m.id)
 	} else {
 		common.Debugf("No route matching %s %s", strings.ToUpper(method), path)
 	}
@@ -94,12 +111,12 @@ func identifyRoute(path, method string) (routeID int, found bool) {
 // does so using a map from compressed to expanded path and query parameter
 // values. This map must be the same and/or compatible on both proxies for this
 // to function.
-func genExpandedPath(
+func (ms *mapSet) genExpandedPath(
 	srcPath string, args []string, query string, trailingSlash bool, routeID int,
 ) (path string, err error) {
 	q, err := url.ParseQuery(query)
 	if err != nil {
-		return
+		return "", newDecodeError(coap.BadOption, "Invalid query string: %v", err)
 	}
 
 	if len(q.Encode()) > 0 {
@@ -108,7 +125,10 @@ func genExpandedPath(
 
 		for key, values := range q {
 			if i, err := strconv.Atoi(key); err == nil {
-				buf[queryParams[i]] = values
+				if i < 0 || i >= len(ms.queryParams) {
+					return "", newDecodeError(coap.BadOption, "Unknown query parameter index %d", i)
+				}
+				buf[ms.queryParams[i]] = values
 			} else {
 				buf[key] = values
 			}
@@ -118,13 +138,17 @@ func genExpandedPath(
 	}
 
 	if routeID >= 0 {
-		path = routes[routeID].Path
+		if routeID >= len(ms.routes) {
+			return "", newDecodeError(coap.BadOption, "Unknown route ID %d", routeID)
+		}
+
+		path = ms.routes[routeID].Path
 
 		if len(args) > 0 {
 			matches := routePatternRgxp.FindAllString(path, -1)
 			var arg string
 			for i := 0; i < len(args) && i < len(matches); i++ {
-				arg, err = getArgFromReq(matches[i], args[i])
+				arg, err = ms.getArgFromReq(matches[i], args[i])
 				if err != nil {
 					return
 				}
@@ -149,8 +173,9 @@ func genExpandedPath(
 
 // genCompressedPath gets given a request path, attempts to compress the query
 // parameters using a map, and afterwards stitches together the potentially
-// compressed path and query parameters into one, which it then returns.
-func genCompressedPath(uri *url.URL, routeID int) string {
+// compressed path and query parameters into one, which it then returns. The
+// path is only compressed if it matched a route, i.e. m isn't nil.
+func (ms *mapSet) genCompressedPath(uri *url.URL, m *routeMatch) string {
 	common.Debugf("Compressing %s", uri.String())
 
 	if len(uri.RawQuery) > 1 {
@@ -160,7 +185,7 @@ func genCompressedPath(uri *url.URL, routeID int) string {
 		for key, values := range uri.Query() {
 			common.Debugf("Compression: Processing query param %s", key)
 
-			index, found := queryParamsIndex(key)
+			index, found := ms.queryParamsIndex(key)
 			if found {
 				buf[strconv.Itoa(index)] = values
 			} else {
@@ -175,22 +200,16 @@ func genCompressedPath(uri *url.URL, routeID int) string {
 
 	var path string
 
-	if routeID >= 0 {
-		deconstructedPath := strings.Split(uri.Path, "/")
-		deconstructedRoute := strings.Split(routes[routeID].Path, "/")
-
-		args := make([]string, 0)
-		for i := 0; i < len(deconstructedRoute) && i < len(deconstructedPath); i++ {
-			if routePatternRgxp.MatchString(deconstructedRoute[i]) {
-				arg := compressReqArg(deconstructedRoute[i], deconstructedPath[i])
-				args = append(args, arg)
-			}
+	if m != nil {
+		args := make([]string, 0, len(m.args))
+		for i, arg := range m.args {
+			args = append(args, ms.compressReqArg(m.patterns[i], arg))
 		}
 
 		if len(args) > 0 {
-			path = fmt.Sprintf("/%s/%s", strconv.FormatInt(int64(routeID), 32), strings.Join(args, "/"))
+			path = fmt.Sprintf("/%s/%s", strconv.FormatInt(int64(m.id), 32), strings.Join(args, "/"))
 		} else {
-			path = fmt.Sprintf("/%s", strconv.FormatInt(int64(routeID), 32))
+			path = fmt.Sprintf("/%s", strconv.FormatInt(int64(m.id), 32))
 		}
 
 		splitURI := strings.Split(uri.String(), "?")
@@ -212,12 +231,15 @@ func genCompressedPath(uri *url.URL, routeID int) string {
 
 // getArgFromReq is a function that retreives an argument from a request given a
 // pattern type.
-func getArgFromReq(match, arg string) (string, error) {
+func (ms *mapSet) getArgFromReq(match, arg string) (string, error) {
 	switch match {
 	case patternEventType:
 		typeID, err := strconv.Atoi(arg)
 		if err == nil {
-			arg = eventTypes[typeID]
+			if typeID < 0 || typeID >= len(ms.eventTypes) {
+				return "", newDecodeError(coap.BadOption, "Unknown event type index %d", typeID)
+			}
+			arg = ms.eventTypes[typeID]
 		}
 	case patternRoomID, patternEventID, patternRoomAlias, patternUserID, patternRoomIDOrAlias:
 		arg = getSigil(match) + arg
@@ -229,12 +251,12 @@ func getArgFromReq(match, arg string) (string, error) {
 
 // compressReqArg is a function that compresses a request argument using its
 // corresponding pattern type
-func compressReqArg(pattern, arg string) string {
+func (ms *mapSet) compressReqArg(pattern, arg string) string {
 	oldVal := arg
 
 	switch pattern {
 	case patternEventType:
-		index, found := eventTypeIndex(arg)
+		index, found := ms.eventTypeIndex(arg)
 		if found {
 			arg = strconv.Itoa(index)
 		}
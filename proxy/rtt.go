@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/common"
+	"github.com/matrix-org/coap-proxy/types"
+)
+
+// rttEstimator is a struct that estimates the retransmission timeout of a peer
+// from the round-trip times of the messages sent to it, the way CoCoA does
+// (draft-ietf-core-cocoa). Messages which weren't retransmitted update a
+// "strong" RFC 6298 estimator, the other ones a "weak" estimator which
+// measures from the first transmission and reacts less to the variation. Both
+// are then blended into the overall retransmission timeout, the weak one with
+// a lower weight.
+type rttEstimator struct {
+	mut    sync.Mutex
+	strong rttState
+	weak   rttState
+	// rto is the overall retransmission timeout, which starts at the
+	// configured initial backoff.
+	rto time.Duration
+}
+
+// rttState is a struct that holds the state of an RFC 6298 estimator.
+type rttState struct {
+	samples uint64
+	srtt    time.Duration
+	rttvar  time.Duration
+}
+
+// rttSnapshot is a struct that holds the estimates of an rttEstimator at a
+// given time.
+type rttSnapshot struct {
+	strong rttState
+	weak   rttState
+	rto    time.Duration
+}
+
+// update is a function that adds a round-trip time measurement to the state
+// and returns the resulting retransmission timeout, with k the weight of the
+// variation.
+func (s *rttState) update(rtt time.Duration, k time.Duration) time.Duration {
+	if s.samples == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := s.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		// RTTVAR has to be updated before SRTT, as it uses its previous value.
+		s.rttvar += (delta - s.rttvar) / 4
+		s.srtt += (rtt - s.srtt) / 8
+	}
+	s.samples++
+
+	return s.srtt + k*s.rttvar
+}
+
+// sample is a function that records the round-trip time of a message which
+// needed retransmissions if weak is true.
+func (e *rttEstimator) sample(rtt time.Duration, weak bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if weak {
+		rto := e.weak.update(rtt, 1)
+		e.rto = (rto + 3*e.rto) / 4
+	} else {
+		rto := e.strong.update(rtt, 4)
+		e.rto = (rto + e.rto) / 2
+	}
+}
+
+// snapshot is a function that returns the current estimates.
+func (e *rttEstimator) snapshot() rttSnapshot {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	return rttSnapshot{strong: e.strong, weak: e.weak, rto: e.rto}
+}
+
+// rttTracker is a struct that holds the rttEstimator of each peer, by the
+// address requests are sent to.
+type rttTracker struct {
+	mut        sync.Mutex
+	estimators map[string]*rttEstimator
+}
+
+// newRTTTracker is a function that returns an empty rttTracker.
+func newRTTTracker() *rttTracker {
+	return &rttTracker{estimators: make(map[string]*rttEstimator)}
+}
+
+// get is a function that returns the estimator of the given target, creating
+// it with the given initial retransmission timeout if it doesn't exist.
+func (t *rttTracker) get(target string, initial time.Duration) *rttEstimator {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	e, ok := t.estimators[target]
+	if !ok {
+		e = &rttEstimator{rto: initial}
+		t.estimators[target] = e
+	}
+
+	return e
+}
+
+// lookup is a function that returns the estimator of the given target, which
+// must exist.
+func (t *rttTracker) lookup(target string) *rttEstimator {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	return t.estimators[target]
+}
+
+// targets is a function that returns the targets which have an estimator, in
+// alphabetical order.
+func (t *rttTracker) targets() []string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	targets := make([]string, 0, len(t.estimators))
+	for target := range t.estimators {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// longPollingRoutes are the names of the routes of the requests the homeserver
+// only answers once it has something new, whose round-trip times say more
+// about the homeserver than about the network.
+var longPollingRoutes = map[string]bool{
+	"sync": true,
+}
+
+// recordRTT is a function that feeds the round-trip times of the messages of an
+// exchange on the given route which completed on the given connection to the
+// estimator of its target, and returns whether any was retransmitted. Each
+// message's round trip goes from its first transmission to its
+// acknowledgement, and is weak if the connection's retries queue retransmitted
+// it meanwhile. go-coap doesn't report its retransmissions, but its schedule
+// only depends on the time since the first transmission. Exchanges on
+// long-polling routes are left out, as their answer being late doesn't mean
+// anything got retransmitted.
+func (c *openConn) recordRTT(msgs []types.SentMessage, routeName string) (retransmitted bool) {
+	if longPollingRoutes[routeName] {
+		return false
+	}
+
+	for _, m := range msgs {
+		if !m.Acked {
+			continue
+		}
+
+		n := c.settings.retries.retransmissions(m.RTT)
+		if n > 0 {
+			retransmitted = true
+		}
+
+		common.Debugf("Measured a round-trip time of %v to %s (retransmissions: %d)", m.RTT, c.target, n)
+
+		c.rtt.sample(m.RTT, n > 0)
+	}
+
+	return
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/coap-proxy/types"
+)
+
+// newRTTTestConn is a function that returns a connection which only has what
+// recordRTT needs, retransmitting after 100ms and then 200ms.
+func newRTTTestConn() *openConn {
+	c := &openConn{target: "127.0.0.1:15683"}
+	c.settings.retries = RetryOptions{InitialBackoff: 100 * time.Millisecond, Multiplier: 2}
+	c.rtt = &rttEstimator{rto: c.settings.retries.InitialBackoff}
+	return c
+}
+
+func TestRecordRTT(t *testing.T) {
+	c := newRTTTestConn()
+
+	fast := []types.SentMessage{{ID: 1, Acked: true, RTT: 50 * time.Millisecond}}
+	if c.recordRTT(fast, "send_transaction") {
+		t.Fatal("Expected a message acknowledged before the first retransmission not to be retransmitted")
+	}
+
+	slow := []types.SentMessage{
+		{ID: 2, Acked: true, RTT: 50 * time.Millisecond},
+		{ID: 3, Acked: true, RTT: 150 * time.Millisecond},
+		{ID: 4, RTT: time.Second},
+	}
+	if !c.recordRTT(slow, "send_transaction") {
+		t.Fatal("Expected a message acknowledged after the first retransmission to be retransmitted")
+	}
+
+	s := c.rtt.snapshot()
+	if s.strong.samples != 2 || s.weak.samples != 1 {
+		t.Fatalf("Expected 2 strong and 1 weak samples, got %d and %d", s.strong.samples, s.weak.samples)
+	}
+}
+
+func TestRecordRTTLongPolling(t *testing.T) {
+	c := newRTTTestConn()
+
+	// A sync the homeserver held open for a while is answered long after
+	// the retransmissions would have started, without any happening.
+	held := []types.SentMessage{{ID: 1, Acked: true, RTT: 30 * time.Second}}
+	if c.recordRTT(held, "sync") {
+		t.Fatal("Expected a long-polling exchange never to count as retransmitted")
+	}
+
+	if s := c.rtt.snapshot(); s.strong.samples != 0 || s.weak.samples != 0 || s.rto != 100*time.Millisecond {
+		t.Fatalf("Expected a long-polling exchange not to be sampled, got %+v", s)
+	}
+}
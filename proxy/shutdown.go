@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// requestTracker is a struct that counts the requests being served, and stops
+// letting new ones in once draining has started.
+type requestTracker struct {
+	mut      sync.Mutex
+	draining bool
+	inFlight int
+	// drained is closed once draining has started and no request is being
+	// served anymore.
+	drained chan struct{}
+}
+
+// newRequestTracker returns a new instance of the requestTracker struct.
+func newRequestTracker() *requestTracker {
+	return &requestTracker{
+		drained: make(chan struct{}),
+	}
+}
+
+// begin is a function that records that a request is being served. It returns
+// false if draining has started, in which case the request must be turned down
+// and end mustn't be called.
+func (t *requestTracker) begin() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.draining {
+		return false
+	}
+
+	t.inFlight++
+	return true
+}
+
+// end is a function that records that a request is done being served.
+func (t *requestTracker) end() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.inFlight--
+	if t.draining && t.inFlight == 0 {
+		close(t.drained)
+	}
+}
+
+// drain is a function that stops letting new requests in, and waits for the
+// ones being served to be done, or for the given context to expire. It returns
+// the number of requests still being served.
+func (t *requestTracker) drain(ctx context.Context) int {
+	t.mut.Lock()
+	if !t.draining {
+		t.draining = true
+		if t.inFlight == 0 {
+			close(t.drained)
+		}
+	}
+	t.mut.Unlock()
+
+	select {
+	case <-t.drained:
+	case <-ctx.Done():
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.inFlight
+}
+
+// Shutdown is a function that stops accepting new requests, waits for the ones
+// being served to be done or for the given context to expire, stops the
+// servers started by Start and closes the connections to other proxies. It
+// returns the context's error if requests were still being served when it
+// expired.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	// Let the syncs waiting for notifications be sent as they are, and stop
+	// syncing on behalf of other proxies.
+	p.observations.closeAll()
+	p.observers.closeAll()
+
+	// Queued requests which haven't been sent yet stay stored for the next
+	// start.
+	if p.forwarding != nil {
+		p.forwarding.close()
+	}
+
+	// Shutting the HTTP servers down closes their listeners straight away, and
+	// waits for the requests they're serving to be done.
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{p.httpServer, p.adminServer} {
+		if srv == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil && err != ctx.Err() {
+				log.Printf("WARNING: Failed to shut an HTTP server down cleanly: %v", err)
+			}
+		}(srv)
+	}
+
+	// CoAP requests come in over UDP, so we can't stop accepting them without
+	// also preventing the responses to the ones being served from being sent.
+	// Turn them down instead until those are done.
+	var err error
+	if left := p.requests.drain(ctx); left > 0 {
+		log.Printf("WARNING: Shutting down with %d requests still in flight", left)
+		err = ctx.Err()
+	}
+
+	wg.Wait()
+
+	if p.coapServer != nil {
+		if shutdownErr := p.coapServer.Shutdown(); shutdownErr != nil {
+			// The server may not have started serving yet, in which case
+			// closing its socket makes it stop as soon as it does.
+			_ = p.coapConn.Close()
+		}
+	}
+
+	p.serving.Wait()
+
+	// Close all open CoAP connections
+	if closeErr := p.conns.closeAll(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return err
+}
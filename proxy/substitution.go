@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import "strings"
 
@@ -44,8 +44,8 @@ func removeSigil(pattern, arg string) string {
 // eventTypeIndex is a function that encodes an event type to an integer
 // integer using the eventTypes map.
 // Found is false if encoding was not possible, otherwise true.
-func eventTypeIndex(t string) (index int, found bool) {
-	for i, eventType := range eventTypes {
+func (ms *mapSet) eventTypeIndex(t string) (index int, found bool) {
+	for i, eventType := range ms.eventTypes {
 		if strings.EqualFold(t, eventType) {
 			index = i
 			found = true
@@ -56,26 +56,11 @@ func eventTypeIndex(t string) (index int, found bool) {
 	return
 }
 
-// matrixErrorIndex is a function that encodes a known matrix error (e.g.
-// M_UNKNOWN) as an integer using the errorCodes map.
-// Found is false if encoding was not possible, otherwise true.
-func matrixErrorIndex(errCode string) (index int, found bool) {
-	for i, code := range errorCodes {
-		if strings.EqualFold(errCode, code) {
-			index = i
-			found = true
-			break
-		}
-	}
-
-	return
-}
-
 // queryParamsIndex is a function that encodes a query parameter key as an
 // integer using the queryParams map.
 // Found is false if encoding was not possible, otherwise true.
-func queryParamsIndex(key string) (index int, found bool) {
-	for i, qp := range queryParams {
+func (ms *mapSet) queryParamsIndex(key string) (index int, found bool) {
+	for i, qp := range ms.queryParams {
 		if key == qp {
 			index = i
 			found = true
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	olog "github.com/opentracing/opentracing-go/log"
+)
+
+var (
+	s1 = rand.NewSource(time.Now().UnixNano())
+	r1 = &lockedRand{r: rand.New(s1)}
+)
+
+// lockedRand is a struct that wraps a *rand.Rand so that the requests sent
+// concurrently can all draw their tokens and message IDs from it.
+type lockedRand struct {
+	mut sync.Mutex
+	r   *rand.Rand
+}
+
+// Intn is a function that returns a random integer in [0,n).
+func (l *lockedRand) Intn(n int) int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.r.Intn(n)
+}
+
+// Read is a function that fills the given slice with random bytes.
+func (l *lockedRand) Read(b []byte) (int, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.r.Read(b)
+}
+
+func randSlice(n int) []byte {
+	token := make([]byte, n)
+	r1.Read(token)
+	return token
+}
+
+// handleErr is a function that takes an error and an opentracing span and
+// performs the necessary error handling functions such and printing relevant
+// information and adding the error to the span.
+// The span can be nil if the error occurred before it could be started.
+func handleErr(err error, serverSpan opentracing.Span) {
+	if serverSpan != nil {
+		ext.Error.Set(serverSpan, true)
+		serverSpan.LogFields(olog.Error(err))
+	}
+	log.Println("ERROR:", err)
+}
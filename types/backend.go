@@ -0,0 +1,161 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of the compression backends a Compressor can use with its dictionary.
+const (
+	BackendFlate = "flate"
+	BackendZstd  = "zstd"
+)
+
+// ZstdDictFile is the name of the optional file in the maps directory holding
+// a dictionary trained for zstd, as generated by the gen-maps subcommand. If
+// it's missing, the zstd backend uses the same dictionary as flate as raw
+// history.
+const ZstdDictFile = "zstd_dict"
+
+// zstdMagic is the magic number every zstd frame starts with. It's stripped
+// from compressed payloads since their tag already says what they are.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Backend is implemented by the compression algorithms a Compressor can use
+// to compress payloads with its dictionary.
+type Backend interface {
+	// Compress compresses a given byte array.
+	Compress(j []byte) ([]byte, error)
+	// Decompress decompresses a given byte array.
+	Decompress(j []byte) ([]byte, error)
+}
+
+// NewBackend returns a new instance of the backend with the given name, using
+// the given dictionary. mapsDir is the maps directory the dictionary was built
+// from, which the backend can look for backend-specific files in.
+// Returns an error if the name is unknown or the backend couldn't be set up.
+func NewBackend(name string, mapsDir string, dict []byte) (Backend, error) {
+	switch name {
+	case BackendFlate:
+		return &flateBackend{dict: dict}, nil
+	case BackendZstd:
+		return newZstdBackend(mapsDir, dict)
+	default:
+		return nil, fmt.Errorf("unknown compression backend %q", name)
+	}
+}
+
+// flateBackend is a Backend compressing with DEFLATE and a preset dictionary.
+type flateBackend struct {
+	dict []byte
+}
+
+// Compress implements Backend.
+func (f *flateBackend) Compress(j []byte) ([]byte, error) {
+	return compress(j, f.dict)
+}
+
+// Decompress implements Backend.
+func (f *flateBackend) Decompress(j []byte) ([]byte, error) {
+	return decompress(j, f.dict)
+}
+
+// zstdBackend is a Backend compressing with Zstandard and a dictionary.
+type zstdBackend struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// newZstdBackend returns a new instance of the zstdBackend struct, using the
+// trained dictionary in the given maps directory if there's one, or the given
+// dictionary as raw history otherwise.
+func newZstdBackend(mapsDir string, dict []byte) (*zstdBackend, error) {
+	var encDict zstd.EOption
+	var decDict zstd.DOption
+
+	trained, err := ioutil.ReadFile(filepath.Join(mapsDir, ZstdDictFile))
+	if err == nil {
+		encDict = zstd.WithEncoderDict(trained)
+		decDict = zstd.WithDecoderDicts(trained)
+	} else if os.IsNotExist(err) {
+		// An ID of 0 means it isn't written in the frames' headers.
+		encDict = zstd.WithEncoderDictRaw(0, dict)
+		decDict = zstd.WithDecoderDictRaw(0, dict)
+	} else {
+		return nil, err
+	}
+
+	// Every byte counts on the links we're targeting, so leave out the
+	// checksum (UDP and noise already take care of integrity) and write the
+	// content size in the frames' headers instead of a window size.
+	enc, err := zstd.NewWriter(
+		nil,
+		encDict,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderCRC(false),
+		zstd.WithSingleSegment(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't let a frame claim a window or a content size larger than what we
+	// accept to decompress.
+	dec, err := zstd.NewReader(
+		nil,
+		decDict,
+		zstd.WithDecoderMaxMemory(MaxDecompressedSize),
+		zstd.WithDecoderMaxWindow(MaxDecompressedSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdBackend{enc: enc, dec: dec}, nil
+}
+
+// Compress implements Backend.
+func (z *zstdBackend) Compress(j []byte) ([]byte, error) {
+	return bytes.TrimPrefix(z.enc.EncodeAll(j, nil), zstdMagic), nil
+}
+
+// Decompress implements Backend.
+func (z *zstdBackend) Decompress(j []byte) ([]byte, error) {
+	// Empty input is compressed to nothing rather than an empty frame.
+	if len(j) == 0 {
+		return j, nil
+	}
+
+	frame := make([]byte, 0, len(zstdMagic)+len(j))
+	frame = append(frame, zstdMagic...)
+	frame = append(frame, j...)
+
+	b, err := z.dec.DecodeAll(frame, nil)
+	if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+		return nil, ErrTooLarge
+	}
+
+	return b, err
+}
@@ -20,9 +20,10 @@ package types
 import (
 	"bytes"
 	"compress/flate"
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -35,22 +36,60 @@ import (
 
 // destTable is a struct that contains a list of servers and a distance cost. It
 // is used in fanout routing for determining which servers to relay federation
-// traffic through.
+// traffic through. servers are the indices of the servers in the server names
+// registry, and unknown the names of the ones which aren't in it.
 type destTable struct {
 	cost    uint
 	servers []uint
+	unknown []interface{}
 }
 
+// NoDictTag is the tag prefixed to payloads compressed without any
+// dictionary. Such payloads can be decompressed by any peer regardless of the
+// maps it loaded, which is what allows falling back to it when peers disagree.
+// It takes a single byte, while the tags of dictionaries take two, the first of
+// which is never NoDictTag.
+const NoDictTag = 0
+
+// ErrUnknownDict is returned when trying to decompress a payload that was
+// compressed with a dictionary we don't have.
+var ErrUnknownDict = errors.New("payload was compressed with an unknown dictionary")
+
+// ErrTooLarge is returned when a payload decompresses to more than
+// MaxDecompressedSize bytes.
+var ErrTooLarge = errors.New("payload decompresses to too many bytes")
+
+// MaxDecompressedSize is the largest size in bytes a payload can decompress
+// to. It's well above the size of the largest federation transactions and
+// syncs, and stops a small payload from exhausting our memory.
+const MaxDecompressedSize = 32 << 20
+
 // Compressor implements go-coap.Compressor
 type Compressor struct {
-	dict []byte // dict is a dictionary of common string values to flate data
-	cbor *CBOR  // cbor is an instance of a cbor struct for de/encoding CBOR data
+	dict    []byte                 // dict is a dictionary of common string values to flate data
+	backend Backend                // backend compresses payloads with dict
+	keys    *substTable            // keys are the map keys substituted with their index
+	values  map[string]*substTable // values are the values substituted with their index, by key
+	servers *substTable            // servers are the server names destination tables refer to by index
+	version string                 // version identifies the maps set the dictionary was built from
+	tag     uint16                 // tag is prefixed to payloads compressed with dict
+	cbor    *CBOR                  // cbor is an instance of a cbor struct for de/encoding CBOR data
 }
 
 // NewCompressor returns a new instance of the Compressor struct with its
-// dictionary initialised from the given files.
+// dictionary initialised from the given files. version is the version of the
+// whole maps set, as computed by MapsVersion, and backend is the name of the
+// compression backend to use with the dictionary.
 // Returns an error if the files couldn't be parsed or read.
-func NewCompressor(mapsDir string, mapFiles []string, cborStruct *CBOR) (*Compressor, error) {
+func NewCompressor(
+	mapsDir string, mapFiles []string, version string, backend string,
+	cborStruct *CBOR,
+) (*Compressor, error) {
+	tag, err := versionTag(version)
+	if err != nil {
+		return nil, err
+	}
+
 	c := new(Compressor)
 
 	var d = ""
@@ -88,17 +127,112 @@ func NewCompressor(mapsDir string, mapFiles []string, cborStruct *CBOR) (*Compre
 	}
 
 	c.dict = append([]byte(d), parsedBytes...)
+	if c.backend, err = NewBackend(backend, mapsDir, c.dict); err != nil {
+		return nil, err
+	}
+
+	if c.keys, err = loadSubstTable(mapsDir, commonKeysFile); err != nil {
+		return nil, err
+	}
+
+	// Keys sharing a file share its table.
+	tables := make(map[string]*substTable)
+	c.values = make(map[string]*substTable, len(valueFiles))
+	for key, f := range valueFiles {
+		if _, loaded := tables[f]; !loaded {
+			if tables[f], err = loadSubstTable(mapsDir, f); err != nil {
+				return nil, err
+			}
+		}
+
+		c.values[key] = tables[f]
+	}
+
+	if c.servers, err = loadServerNames(mapsDir); err != nil {
+		return nil, err
+	}
+	c.version = version
+	c.tag = tag
 	c.cbor = cborStruct
 
 	return c, nil
 }
 
-// CompressPayload compresses a given byte array
+// Version returns the version of the maps set the compressor was built from.
+func (c *Compressor) Version() string {
+	return c.version
+}
+
+// Tag returns the tag prefixed to payloads compressed with the dictionary.
+func (c *Compressor) Tag() uint16 {
+	return c.tag
+}
+
+// CompressPayload compresses a given byte array using the dictionary.
 func (c *Compressor) CompressPayload(j []byte) ([]byte, error) {
+	b, err := c.backend.Compress(j)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{byte(c.tag >> 8), byte(c.tag)}, b...), nil
+}
+
+// CompressPayloadNoDict compresses a given byte array without using the
+// dictionary, so that peers with different maps can still decompress it.
+// Payloads compressed without a dictionary always use flate regardless of the
+// backend, as that's what every peer understands.
+func (c *Compressor) CompressPayloadNoDict(j []byte) ([]byte, error) {
+	return compressNoDict(j)
+}
+
+// DecompressPayload decompresses a given byte array, using the dictionary
+// its tag says it was compressed with.
+func (c *Compressor) DecompressPayload(j []byte) ([]byte, error) {
+	if len(j) == 0 {
+		return j, nil
+	}
+
+	tag, n, err := PayloadTag(j)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case NoDictTag:
+		return decompress(j[n:], nil)
+	case c.tag:
+		return c.backend.Decompress(j[n:])
+	default:
+		return nil, ErrUnknownDict
+	}
+}
+
+// PayloadTag returns the tag a given compressed payload starts with, and how
+// many bytes it takes.
+// Returns an error if the payload is too short to hold a tag.
+func PayloadTag(j []byte) (tag uint16, n int, err error) {
+	if len(j) == 0 {
+		return 0, 0, errors.New("payload has no tag")
+	}
+
+	if j[0] == NoDictTag {
+		return NoDictTag, 1, nil
+	}
+
+	if len(j) < 2 {
+		return 0, 0, errors.New("payload has a truncated tag")
+	}
+
+	return uint16(j[0])<<8 | uint16(j[1]), 2, nil
+}
+
+// compress compresses a given byte array with flate and the given dictionary.
+func compress(j []byte, dict []byte) ([]byte, error) {
 	var b bytes.Buffer
 
 	// Compress the data using the specially crafted dictionary.
-	zw, err := flate.NewWriterDict(&b, flate.BestCompression, c.dict)
+	zw, err := flate.NewWriterDict(&b, flate.BestCompression, dict)
 	if err != nil {
 		return nil, err
 	}
@@ -114,15 +248,30 @@ func (c *Compressor) CompressPayload(j []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-// DecompressPayload decompresses a given byte array
-func (c *Compressor) DecompressPayload(j []byte) ([]byte, error) {
+// compressNoDict compresses a given byte array with flate and no dictionary,
+// and prefixes the result with NoDictTag.
+func compressNoDict(j []byte) ([]byte, error) {
+	b, err := compress(j, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{NoDictTag}, b...), nil
+}
+
+// decompress decompresses a given byte array with the given dictionary.
+func decompress(j []byte, dict []byte) ([]byte, error) {
 	var b bytes.Buffer
 
-	zr := flate.NewReaderDict(bytes.NewReader(j), c.dict)
+	zr := flate.NewReaderDict(bytes.NewReader(j), dict)
 
-	if _, err := io.Copy(&b, zr); err != nil {
+	n, err := io.Copy(&b, io.LimitReader(zr, MaxDecompressedSize+1))
+	if err != nil {
 		return nil, err
 	}
+	if n > MaxDecompressedSize {
+		return nil, ErrTooLarge
+	}
 
 	if err := zr.Close(); err != nil {
 		return nil, err
@@ -132,7 +281,8 @@ func (c *Compressor) DecompressPayload(j []byte) ([]byte, error) {
 }
 
 // CompressTransaction is a function that compresses PDU bodies and destination
-// tables held inside a federation transaction.
+// tables held inside a federation transaction, and interns the server names of
+// its identifiers.
 func (c *Compressor) CompressTransaction(val interface{}) interface{} {
 	bodyMap, ok := val.(map[interface{}]interface{})
 	if !ok {
@@ -141,7 +291,7 @@ func (c *Compressor) CompressTransaction(val interface{}) interface{} {
 
 	pduSlice, ok := bodyMap["pdus"].([]interface{})
 	if !ok {
-		return val
+		return c.InternServerNames(val)
 	}
 
 	for i := range pduSlice {
@@ -158,7 +308,7 @@ func (c *Compressor) CompressTransaction(val interface{}) interface{} {
 		pduUnsigned["dtab"] = c.compressDestTable(pduUnsigned["dtab"])
 	}
 
-	return val
+	return c.InternServerNames(val)
 }
 
 // DecompressTransaction is a function that compresses a transaction for
@@ -169,6 +319,8 @@ func (c *Compressor) DecompressTransaction(val interface{}) interface{} {
 		return val
 	}
 
+	c.RestoreServerNames(bodyMap)
+
 	pduSlice, ok := bodyMap["pdus"].([]interface{})
 	if !ok {
 		return val
@@ -192,7 +344,9 @@ func (c *Compressor) DecompressTransaction(val interface{}) interface{} {
 }
 
 // compressDestTable is a function that encodes the destinations in a
-// destTable into an integer.
+// destTable into a bit field of their indices in the server names registry.
+// The names of the destinations which aren't in the registry are kept along
+// with the bit field.
 func (c *Compressor) compressDestTable(val interface{}) interface{} {
 	destTableSlice, ok := val.([]interface{})
 	if !ok {
@@ -216,30 +370,31 @@ func (c *Compressor) compressDestTable(val interface{}) interface{} {
 		}
 
 		var servers []uint
+		var unknown []interface{}
 		if slice, ok := entrySlice[1].([]interface{}); ok {
 			for _, s := range slice {
 				if k, ok := s.(string); ok {
-					// TODO: fs-specific stuff
-					k = strings.Replace(k, "synapse", "", 1)
-					u, err := strconv.ParseUint(k, 10, 64)
-					if err == nil {
-						servers = append(servers, uint(u))
+					if idx, ok := c.servers.idx[k]; ok {
+						servers = append(servers, uint(idx))
+					} else {
+						unknown = append(unknown, k)
 					}
 				}
 			}
 		}
 
-		if len(servers) == 0 {
+		if len(servers) == 0 && len(unknown) == 0 {
 			continue
 		}
 
 		entries = append(entries, destTable{
 			cost:    uint(cost),
 			servers: servers,
+			unknown: unknown,
 		})
 	}
 
-	finalMap := make(map[uint]bitfield.BitField)
+	finalMap := make(map[uint]interface{})
 
 	if len(entries) == 0 {
 		return finalMap
@@ -255,25 +410,32 @@ func (c *Compressor) compressDestTable(val interface{}) interface{} {
 
 		common.Debug("Max server is:", maxServer)
 
-		field := bitfield.New(int(maxServer) + 1)
+		var field bitfield.BitField
+		if len(entry.servers) > 0 {
+			field = bitfield.New(int(maxServer) + 1)
+		}
 
 		for _, s := range entry.servers {
 			field.Set(uint32(s))
 		}
 
-		finalMap[entry.cost] = field
+		if len(entry.unknown) > 0 {
+			finalMap[entry.cost] = []interface{}{[]byte(field), entry.unknown}
+		} else {
+			finalMap[entry.cost] = field
+		}
 	}
 
 	return finalMap
 }
 
 // decompressDestTable is a function that decodes the destinations in a
-// destTable from an integer back into their original addresses.
+// destTable from a bit field back into their original addresses.
 func (c *Compressor) decompressDestTable(val interface{}) interface{} {
 	// Cheekily just serialize/deserialize to save having to manually parse stuff
 	bytes := c.cbor.Encode(val)
 
-	var destTableMap map[uint][]byte
+	var destTableMap map[uint]interface{}
 
 	var cborH codec.Handle = new(codec.CborHandle)
 	dec := codec.NewDecoderBytes(bytes, cborH)
@@ -283,16 +445,43 @@ func (c *Compressor) decompressDestTable(val interface{}) interface{} {
 	}
 
 	var finalSlice []interface{}
-	for cost, bits := range destTableMap {
+	for cost, dests := range destTableMap {
 		var entry []interface{}
 		entry = append(entry, cost)
 
+		// Destinations which aren't all in the registry come as the bit field
+		// followed by the names of the other ones.
+		var bits []byte
+		var unknown []interface{}
+		switch v := dests.(type) {
+		case []byte:
+			bits = v
+		case []interface{}:
+			if len(v) != 2 {
+				return val
+			}
+			bits, _ = v[0].([]byte)
+			unknown, _ = v[1].([]interface{})
+		default:
+			return val
+		}
+
 		parsedBitfield := bitfield.BitField(bits)
 
-		var servers []string
+		servers := make([]string, 0)
 		for idx := 0; idx < len(bits)*8; idx++ {
 			if parsedBitfield.Test(uint32(idx)) {
-				servers = append(servers, fmt.Sprintf("synapse%d", idx))
+				if idx >= len(c.servers.strs) {
+					log.Printf("WARNING: Server #%d isn't in the server names registry, dropping it", idx)
+					continue
+				}
+				servers = append(servers, c.servers.strs[idx])
+			}
+		}
+
+		for _, s := range unknown {
+			if name, ok := s.(string); ok {
+				servers = append(servers, name)
 			}
 		}
 
@@ -0,0 +1,141 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// InternedTag is the CBOR tag interned server names and identifiers are marked
+// with. Payloads otherwise only hold values decoded from JSON, which never have
+// a tag, so a tagged value can't be mistaken for anything else.
+const InternedTag = 6
+
+// internedKeys are the map keys whose values hold Matrix identifiers (or, for
+// origin, server names) in which server names from the server names registry
+// are replaced with their index.
+var internedKeys = map[string]bool{
+	"origin":      true,
+	"sender":      true,
+	"event_id":    true,
+	"room_id":     true,
+	"prev_events": true,
+	"auth_events": true,
+}
+
+// InternServerNames is a function that recursively replaces the server names
+// of the Matrix identifiers held in a given value under the keys listed in
+// internedKeys with their index in the server names registry. An identifier
+// becomes a list of the part before the server name's colon and the index, and
+// a server name on its own becomes its index, either of which is tagged with
+// InternedTag. Identifiers with a server name which isn't in the registry are
+// left alone.
+func (c *Compressor) InternServerNames(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		for k, el := range v {
+			if key, ok := k.(string); ok && internedKeys[key] {
+				v[k] = c.internIdentifiers(key, el)
+			} else {
+				v[k] = c.InternServerNames(el)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = c.InternServerNames(v[i])
+		}
+	}
+
+	return val
+}
+
+// internIdentifiers is a function that replaces the server names of the Matrix
+// identifiers held in a given value found under the given key, which can be a
+// list of identifiers or of lists holding some (e.g. prev_events in the first
+// room versions).
+func (c *Compressor) internIdentifiers(key string, val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		if key == "origin" {
+			if idx, ok := c.servers.idx[v]; ok {
+				return codec.RawExt{Tag: InternedTag, Value: idx}
+			}
+			return v
+		}
+
+		if i := strings.IndexByte(v, ':'); i > 0 {
+			if idx, ok := c.servers.idx[v[i+1:]]; ok {
+				return codec.RawExt{Tag: InternedTag, Value: []interface{}{v[:i], idx}}
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = c.internIdentifiers(key, v[i])
+		}
+	case map[interface{}]interface{}:
+		return c.InternServerNames(v)
+	}
+
+	return val
+}
+
+// RestoreServerNames is a function that reverts InternServerNames on a given
+// value decoded from CBOR, by restoring the values tagged with InternedTag
+// wherever they are.
+func (c *Compressor) RestoreServerNames(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		for k, el := range v {
+			v[k] = c.RestoreServerNames(el)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = c.RestoreServerNames(v[i])
+		}
+	case codec.RawExt:
+		if v.Tag == InternedTag {
+			return c.restoreInterned(v.Value)
+		}
+	}
+
+	return val
+}
+
+// restoreInterned is a function that reverts internIdentifiers on the value of
+// a tagged server name or identifier. The value is returned as is if it isn't
+// one.
+func (c *Compressor) restoreInterned(val interface{}) interface{} {
+	switch v := val.(type) {
+	case uint64:
+		if v < uint64(len(c.servers.strs)) {
+			return c.servers.strs[v]
+		}
+	case []interface{}:
+		if len(v) == 2 {
+			local, isLocal := v[0].(string)
+			idx, isIdx := v[1].(uint64)
+			if isLocal && isIdx && idx < uint64(len(c.servers.strs)) {
+				return local + ":" + c.servers.strs[idx]
+			}
+		}
+	}
+
+	return val
+}
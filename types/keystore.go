@@ -19,6 +19,7 @@ package types
 
 import (
 	"net"
+	"sync"
 
 	"github.com/flynn/noise"
 )
@@ -26,36 +27,56 @@ import (
 // InMemoryKeyStore is a struct containing remote and local Diffie Hellman keys
 // implemented by the noise protocol library.
 type InMemoryKeyStore struct {
-	remoteKeys     map[net.Addr][]byte
+	mut            sync.RWMutex
+	remoteKeys     map[string][]byte
 	localStaticKey noise.DHKey
 }
 
 // NewKeyStore is a function that creates a new InMemoryKeyStore instance
 func NewKeyStore() *InMemoryKeyStore {
 	keyStore := &InMemoryKeyStore{}
-	keyStore.remoteKeys = make(map[net.Addr][]byte)
+	keyStore.remoteKeys = make(map[string][]byte)
 	return keyStore
 }
 
 // GetLocalKey is a function that returns a static local key from the InMemoryKeyStore
 func (ks *InMemoryKeyStore) GetLocalKey() (noise.DHKey, error) {
+	ks.mut.RLock()
+	defer ks.mut.RUnlock()
 	return ks.localStaticKey, nil
 }
 
 // SetLocalKey is a function that takes in a DHKey and inserts it into the InMemoryKeyStore
 func (ks *InMemoryKeyStore) SetLocalKey(key noise.DHKey) error {
+	ks.mut.Lock()
+	defer ks.mut.Unlock()
 	ks.localStaticKey = key
 	return nil
 }
 
 // GetRemoteKey is a function that returns a remote key from the InMemoryKeyStore
 func (ks *InMemoryKeyStore) GetRemoteKey(addr net.Addr) ([]byte, error) {
-	return ks.remoteKeys[addr], nil
+	ks.mut.RLock()
+	defer ks.mut.RUnlock()
+	return ks.remoteKeys[addrKey(addr)], nil
 }
 
 // SetRemoteKey is a function that takes in a remote key and the address it is
 // associated with and inserts/updates it in the InMemoryKeyStore
 func (ks *InMemoryKeyStore) SetRemoteKey(addr net.Addr, key []byte) error {
-	ks.remoteKeys[addr] = key
+	ks.mut.Lock()
+	defer ks.mut.Unlock()
+	ks.remoteKeys[addrKey(addr)] = key
 	return nil
 }
+
+// addrKey is a function that returns the key to store the remote key of the
+// given address under. go-coap asks for the keys of servers' connections,
+// which don't have a remote address.
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ServerNamesFile is the name of the optional file in the maps directory
+// listing the federation server names which destination tables refer to by
+// their index. If it's missing, every server name is sent as is.
+const ServerNamesFile = "server_names.json"
+
+// loadServerNames is a function that loads the server names registry from the
+// given maps directory, which is empty if it doesn't have one.
+func loadServerNames(mapsDir string) (*substTable, error) {
+	if _, err := os.Stat(filepath.Join(mapsDir, ServerNamesFile)); os.IsNotExist(err) {
+		return newSubstTable(nil), nil
+	}
+
+	return loadSubstTable(mapsDir, ServerNamesFile)
+}
+
+// ServerNames returns the server names destination tables refer to by their
+// index, in the order of their indices.
+func (c *Compressor) ServerNames() []string {
+	return c.servers.strs
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"path/filepath"
+	"reflect"
+)
+
+// commonKeysFile is the name of the file in the maps directory listing the
+// map keys to substitute with their index.
+const commonKeysFile = "common_keys.json"
+
+// valueFiles associates the map keys whose string values are substituted with
+// their index to the file in the maps directory listing these values.
+var valueFiles = map[string]string{
+	"msgtype":    "common_values.json",
+	"membership": "common_values.json",
+	"type":       "event_types.json",
+	"edu_type":   "edu_types.json",
+	"errcode":    "error_codes.json",
+}
+
+// substTable is a struct that holds a list of strings substituted with their
+// index in it.
+type substTable struct {
+	strs []string
+	idx  map[string]uint64
+}
+
+// newSubstTable returns a new instance of the substTable struct for the given
+// list of strings.
+func newSubstTable(strs []string) *substTable {
+	t := &substTable{
+		strs: strs,
+		idx:  make(map[string]uint64, len(strs)),
+	}
+
+	for i, s := range strs {
+		// Keep the first index of duplicated strings so the result doesn't
+		// depend on map iteration order.
+		if _, exists := t.idx[s]; !exists {
+			t.idx[s] = uint64(i)
+		}
+	}
+
+	return t
+}
+
+// loadSubstTable is a function that loads a substTable from a given file in
+// the maps directory, which must contain a JSON list of strings.
+func loadSubstTable(mapsDir string, f string) (*substTable, error) {
+	var strs []string
+	if err := new(JSON).ParseFile(filepath.Join(mapsDir, f), &strs); err != nil {
+		return nil, err
+	}
+
+	return newSubstTable(strs), nil
+}
+
+// substitute is a function that returns the index of a given value if it's a
+// string in the table, or the value shifted past the indices if it's a
+// non-negative integer so it can't be mistaken for an index. Other values are
+// returned as is.
+func (t *substTable) substitute(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if idx, ok := t.idx[s]; ok {
+			return idx
+		}
+		return s
+	}
+
+	// Negative integers are left alone as they are decoded as signed integers,
+	// which are never indices.
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint() + uint64(len(t.strs))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Int() >= 0 {
+			return uint64(rv.Int()) + uint64(len(t.strs))
+		}
+	}
+
+	return v
+}
+
+// restore is a function that reverts substitute on a given value decoded from
+// CBOR, in which non-negative integers are always uint64s.
+func (t *substTable) restore(v interface{}) interface{} {
+	idx, ok := v.(uint64)
+	if !ok {
+		return v
+	}
+
+	if idx < uint64(len(t.strs)) {
+		return t.strs[idx]
+	}
+
+	return idx - uint64(len(t.strs))
+}
+
+// CompressBody is a function that recursively replaces the keys of the maps
+// held in a given value which are listed in common_keys.json, along with the
+// values of some well-known keys (e.g. msgtype or an event's type), with their
+// index in the relevant map file, as CBOR encodes small integers in a single
+// byte.
+// Integers which were already there in place of a substituted key or value are
+// shifted past the indices so they can't be mistaken for one.
+func (c *Compressor) CompressBody(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, el := range v {
+			m[c.keys.substitute(k)] = c.CompressBody(c.compressValue(k, el))
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = c.CompressBody(v[i])
+		}
+		return v
+	}
+
+	// Other types of maps (e.g. the compressed destination tables of a
+	// transaction) can have integer keys too.
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Map {
+		return val
+	}
+
+	m := make(map[interface{}]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		k := iter.Key().Interface()
+		m[c.keys.substitute(k)] = c.CompressBody(c.compressValue(k, iter.Value().Interface()))
+	}
+
+	return m
+}
+
+// DecompressBody is a function that reverts CompressBody on a given value
+// decoded from CBOR.
+func (c *Compressor) DecompressBody(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, el := range v {
+			key := c.keys.restore(k)
+			m[key] = c.decompressValue(key, c.DecompressBody(el))
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = c.DecompressBody(v[i])
+		}
+		return v
+	}
+
+	return val
+}
+
+// compressValue is a function that substitutes the value associated with a
+// given key if the key is one of the well-known ones and the value isn't a
+// container.
+func (c *Compressor) compressValue(key interface{}, val interface{}) interface{} {
+	t := c.valuesTable(key)
+	if t == nil {
+		return val
+	}
+
+	return t.substitute(val)
+}
+
+// decompressValue is a function that reverts compressValue.
+func (c *Compressor) decompressValue(key interface{}, val interface{}) interface{} {
+	t := c.valuesTable(key)
+	if t == nil {
+		return val
+	}
+
+	return t.restore(val)
+}
+
+// valuesTable is a function that returns the table to substitute the values of
+// a given key with, or nil if they aren't substituted.
+func (c *Compressor) valuesTable(key interface{}) *substTable {
+	s, ok := key.(string)
+	if !ok {
+		return nil
+	}
+
+	return c.values[s]
+}
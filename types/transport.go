@@ -0,0 +1,306 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedTokens is the maximum number of tokens a Transport remembers the
+// tag of, or the IDs of the messages sent with.
+const maxTrackedTokens = 4096
+
+// Types of CoAP messages, as written in the header of a marshalled CoAP
+// datagram.
+const (
+	typeConfirmable     = 0
+	typeAcknowledgement = 2
+	typeReset           = 3
+)
+
+// Transport wraps a set of Compressors, one per generation of maps, so they
+// can be given to go-coap as the hook compressing whole CoAP packets. Packets
+// are decompressed with the Compressor their tag designates. Transport also
+// remembers which tag each token's messages were compressed with, so that a
+// response is always compressed the same way as the request it answers. This
+// lets a peer which uses another generation of maps, or fell back to
+// compressing without a dictionary, read our responses.
+// go-coap doesn't tell the compression hook which peer a packet is from or for,
+// so tokens are tracked regardless of the peer. Two peers can pick the same
+// token though, and if they compress their messages differently the token is
+// marked as conflicting, and the responses with it are compressed without any
+// dictionary, which every peer can read.
+// A Transport used by a single connection, i.e. created by NewConnTransport,
+// also remembers the confirmable messages sent with each token, and when they
+// were acknowledged, so the retransmissions of an exchange that's given up on
+// can be cancelled, including the ones of the blocks go-coap picked an ID for,
+// and the round-trip times of an exchange's messages can be measured. Message
+// IDs are only unique within a connection, so a Transport shared by several
+// peers doesn't do it.
+type Transport struct {
+	comps      atomic.Value // comps holds a map[uint16]*Compressor indexed by tag
+	tag        uint32       // tag is the tag new messages are compressed with
+	tracksSent bool         // tracksSent is whether the sent messages are tracked
+	mut        sync.Mutex
+	tokens     map[string]trackedToken
+	tokenLog   []string
+	sent       map[string][]*SentMessage
+	sentLog    []string
+	unacked    map[uint16]*SentMessage // unacked holds the sent messages by ID
+}
+
+// SentMessage is a struct that holds a confirmable message a Transport sent:
+// its ID, and whether it was acknowledged and how long after its first
+// transmission, retransmissions excluded, if so.
+type SentMessage struct {
+	ID     uint16
+	Acked  bool
+	RTT    time.Duration
+	sentAt time.Time
+}
+
+// trackedToken is a struct that holds the tag the messages with a token were
+// compressed with, and whether some were compressed with another tag.
+type trackedToken struct {
+	tag         uint16
+	conflicting bool
+}
+
+// NewTransport returns a new Transport able to decompress packets compressed
+// with any of the given Compressors, and compressing packets which aren't
+// answering another one with the Compressor with the given tag until SetTag
+// says otherwise.
+func NewTransport(comps []*Compressor, tag uint16) *Transport {
+	t := &Transport{
+		tokens:  make(map[string]trackedToken),
+		sent:    make(map[string][]*SentMessage),
+		unacked: make(map[uint16]*SentMessage),
+	}
+	t.SetCompressors(comps)
+	t.SetTag(tag)
+	return t
+}
+
+// NewConnTransport returns a new Transport like NewTransport does, for a
+// single connection, which also tracks the confirmable messages it sends.
+func NewConnTransport(comps []*Compressor, tag uint16) *Transport {
+	t := NewTransport(comps, tag)
+	t.tracksSent = true
+	return t
+}
+
+// SetCompressors replaces the Compressors packets are compressed with, e.g.
+// after the maps have been reloaded.
+func (t *Transport) SetCompressors(comps []*Compressor) {
+	m := make(map[uint16]*Compressor)
+	for _, c := range comps {
+		m[c.Tag()] = c
+	}
+	t.comps.Store(m)
+}
+
+// SetTag sets the tag of the Compressor to compress packets which aren't
+// answering another one with. NoDictTag means not using any dictionary.
+func (t *Transport) SetTag(tag uint16) {
+	atomic.StoreUint32(&t.tag, uint32(tag))
+}
+
+// TokenTag returns the tag the messages with the given token were compressed
+// with.
+// Found is false if no message with this token went through the transport, or
+// if messages with it were compressed with different tags.
+func (t *Transport) TokenTag(token []byte) (tag uint16, found bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	tt, found := t.tokens[string(token)]
+	if !found || tt.conflicting {
+		return 0, false
+	}
+
+	return tt.tag, true
+}
+
+// SentMessages returns the confirmable messages sent with the given token, in
+// the order they were sent, and forgets about them. It always returns none if
+// the Transport doesn't track the messages it sends.
+func (t *Transport) SentMessages(token []byte) []SentMessage {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	msgs := make([]SentMessage, 0, len(t.sent[string(token)]))
+	for _, m := range t.sent[string(token)] {
+		msgs = append(msgs, *m)
+		t.forgetSent(m)
+	}
+	delete(t.sent, string(token))
+
+	return msgs
+}
+
+// CompressPayload implements go-coap.Compressor.
+func (t *Transport) CompressPayload(pkt []byte) ([]byte, error) {
+	token := packetToken(pkt)
+
+	// Messages without a token (e.g. empty ACKs and pings) are too small to
+	// benefit from the dictionary, and may be for a peer that doesn't have it.
+	if len(token) == 0 {
+		return compressNoDict(pkt)
+	}
+
+	t.mut.Lock()
+	if t.tracksSent && (pkt[0]>>4)&0x03 == typeConfirmable {
+		t.trackSent(token, binary.BigEndian.Uint16(pkt[2:4]))
+	}
+	tt, found := t.tokens[string(token)]
+	t.mut.Unlock()
+
+	tag := tt.tag
+	if !found {
+		tag = uint16(atomic.LoadUint32(&t.tag))
+	} else if tt.conflicting {
+		return compressNoDict(pkt)
+	}
+
+	c, ok := t.comps.Load().(map[uint16]*Compressor)[tag]
+	if !ok {
+		return compressNoDict(pkt)
+	}
+
+	return c.CompressPayload(pkt)
+}
+
+// DecompressPayload implements go-coap.Compressor.
+func (t *Transport) DecompressPayload(pkt []byte) ([]byte, error) {
+	if len(pkt) == 0 {
+		return pkt, nil
+	}
+
+	tag, n, err := PayloadTag(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if tag == NoDictTag {
+		b, err = decompress(pkt[n:], nil)
+	} else if c, ok := t.comps.Load().(map[uint16]*Compressor)[tag]; ok {
+		b, err = c.DecompressPayload(pkt)
+	} else {
+		err = ErrUnknownDict
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token := packetToken(b); len(token) > 0 {
+		t.trackToken(token, tag)
+	}
+
+	if t.tracksSent && len(b) >= 4 {
+		if typ := (b[0] >> 4) & 0x03; typ == typeAcknowledgement || typ == typeReset {
+			t.trackAck(binary.BigEndian.Uint16(b[2:4]))
+		}
+	}
+
+	return b, nil
+}
+
+// trackToken records the tag of a message with the given token, forgetting
+// about the oldest token if there are too many. The token is marked as
+// conflicting if it's already tracked with another tag.
+func (t *Transport) trackToken(token []byte, tag uint16) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	key := string(token)
+	tt, exists := t.tokens[key]
+	if !exists {
+		t.tokenLog = append(t.tokenLog, key)
+		if len(t.tokenLog) > maxTrackedTokens {
+			delete(t.tokens, t.tokenLog[0])
+			t.tokenLog = t.tokenLog[1:]
+		}
+	} else if tt.tag != tag {
+		tt.conflicting = true
+	}
+
+	tt.tag = tag
+	t.tokens[key] = tt
+}
+
+// trackSent records a confirmable message sent with the given token, and that
+// it's waiting for an acknowledgement, forgetting about the oldest token if
+// there are too many. The Transport's lock must be held.
+func (t *Transport) trackSent(token []byte, mID uint16) {
+	key := string(token)
+	if _, exists := t.sent[key]; !exists {
+		t.sentLog = append(t.sentLog, key)
+		if len(t.sentLog) > maxTrackedTokens {
+			for _, m := range t.sent[t.sentLog[0]] {
+				t.forgetSent(m)
+			}
+			delete(t.sent, t.sentLog[0])
+			t.sentLog = t.sentLog[1:]
+		}
+	}
+
+	m := &SentMessage{ID: mID, sentAt: time.Now()}
+	t.sent[key] = append(t.sent[key], m)
+	t.unacked[mID] = m
+}
+
+// trackAck records that the sent message with the given ID was acknowledged,
+// if it's waiting for it.
+func (t *Transport) trackAck(mID uint16) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if m, ok := t.unacked[mID]; ok {
+		m.Acked = true
+		m.RTT = time.Since(m.sentAt)
+		delete(t.unacked, mID)
+	}
+}
+
+// forgetSent stops waiting for the acknowledgement of the given sent message.
+// The Transport's lock must be held.
+func (t *Transport) forgetSent(m *SentMessage) {
+	if t.unacked[m.ID] == m {
+		delete(t.unacked, m.ID)
+	}
+}
+
+// packetToken returns the token of a marshalled CoAP datagram, or nil if it
+// doesn't have any or if the datagram is malformed.
+func packetToken(pkt []byte) []byte {
+	if len(pkt) < 4 {
+		return nil
+	}
+
+	tkl := int(pkt[0] & 0x0f)
+	if tkl == 0 || len(pkt) < 4+tkl {
+		return nil
+	}
+
+	return pkt[4 : 4+tkl]
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 New Vector Ltd
+//
+// This file is part of coap-proxy.
+//
+// coap-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// coap-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with coap-proxy.  If not, see <https://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// versionLen is the number of bytes of the maps set's digest kept in its
+// version.
+const versionLen = 8
+
+// VersionFilter is a function that returns the part of the content of a maps
+// file which affects how paths and payloads are compressed, so that changing
+// the rest of the file doesn't change the maps set's version.
+type VersionFilter func(b []byte) ([]byte, error)
+
+// MapsVersion computes the version of a maps set from the content of the
+// given files, passed through their filter if they have one. Two proxies can
+// only understand each other's compressed paths and payloads if they have the
+// same version, which is why the name of the compression backend in use is
+// part of it too.
+// Returns an error if one of the files couldn't be read or filtered.
+func MapsVersion(
+	mapsDir string, mapFiles []string, backend string, filters map[string]VersionFilter,
+) (string, error) {
+	h := sha256.New()
+
+	for _, f := range mapFiles {
+		b, err := ioutil.ReadFile(filepath.Join(mapsDir, f))
+		if err != nil {
+			return "", err
+		}
+
+		if filter, ok := filters[f]; ok {
+			if b, err = filter(b); err != nil {
+				return "", fmt.Errorf("%s: %v", f, err)
+			}
+		}
+
+		// Include the file's name so moving content from one file to another
+		// changes the version.
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+		h.Write(b)
+	}
+
+	// Leave flate out so the versions of existing maps sets don't change.
+	if backend != BackendFlate {
+		h.Write([]byte{0})
+		h.Write([]byte(backend))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:versionLen]), nil
+}
+
+// versionTag derives the tag to prefix payloads compressed with a given
+// version's dictionary with, from the first two bytes of the version. Its
+// first byte is never NoDictTag.
+func versionTag(version string) (uint16, error) {
+	b, err := hex.DecodeString(version)
+	if err != nil {
+		return 0, err
+	}
+
+	b = append(b, 0, 0)
+
+	return uint16(b[0]%255+1)<<8 | uint16(b[1]), nil
+}